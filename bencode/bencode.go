@@ -0,0 +1,169 @@
+// Package bencode implements the encoding used by BitTorrent (BEP 3).
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+)
+
+// Marshal returns the bencoding of v. Strings and byte slices are encoded as
+// byte strings, integers as integers, slices and arrays as lists, and maps
+// with string keys as dictionaries.
+func Marshal(v any) ([]byte, error) {
+	var buff bytes.Buffer
+	if err := encode(&buff, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func encode(buff *bytes.Buffer, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return fmt.Errorf("bencode: unsupported nil value")
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			return fmt.Errorf("bencode: unsupported nil %s", v.Type())
+		}
+		return encode(buff, v.Elem())
+	case reflect.String:
+		writeString(buff, v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buff.WriteByte('i')
+		buff.WriteString(strconv.FormatInt(v.Int(), 10))
+		buff.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buff.WriteByte('i')
+		buff.WriteString(strconv.FormatUint(v.Uint(), 10))
+		buff.WriteByte('e')
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			writeString(buff, string(b))
+			return nil
+		}
+		buff.WriteByte('l')
+		for i := range v.Len() {
+			if err := encode(buff, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buff.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("bencode: unsupported map key type %s", v.Type().Key())
+		}
+		// keys must appear in sorted order
+		keys := v.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return bytes.Compare([]byte(a.String()), []byte(b.String()))
+		})
+		buff.WriteByte('d')
+		for _, k := range keys {
+			writeString(buff, k.String())
+			if err := encode(buff, v.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+		buff.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func writeString(buff *bytes.Buffer, s string) {
+	buff.WriteString(strconv.Itoa(len(s)))
+	buff.WriteByte(':')
+	buff.WriteString(s)
+}
+
+var ErrSyntax = errors.New("bencode: invalid syntax")
+
+// Unmarshal decodes data, which must hold exactly one value. Byte strings are
+// returned as string, integers as int64, lists as []any and dictionaries as
+// map[string]any.
+func Unmarshal(data []byte) (any, error) {
+	v, n, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(data) {
+		return nil, ErrSyntax
+	}
+	return v, nil
+}
+
+// decode returns the value at the start of data and its encoded length.
+func decode(data []byte) (any, int, error) {
+	if len(data) == 0 {
+		return nil, 0, ErrSyntax
+	}
+	switch data[0] {
+	case 'i':
+		end := bytes.IndexByte(data, 'e')
+		if end < 0 {
+			return nil, 0, ErrSyntax
+		}
+		i, err := strconv.ParseInt(string(data[1:end]), 10, 64)
+		if err != nil {
+			return nil, 0, ErrSyntax
+		}
+		return i, end + 1, nil
+	case 'l':
+		list := []any{}
+		n := 1
+		for n < len(data) && data[n] != 'e' {
+			v, size, err := decode(data[n:])
+			if err != nil {
+				return nil, 0, err
+			}
+			list = append(list, v)
+			n += size
+		}
+		if n == len(data) {
+			return nil, 0, ErrSyntax
+		}
+		return list, n + 1, nil
+	case 'd':
+		dict := make(map[string]any)
+		n := 1
+		for n < len(data) && data[n] != 'e' {
+			k, size, err := decodeString(data[n:])
+			if err != nil {
+				return nil, 0, err
+			}
+			n += size
+			v, size, err := decode(data[n:])
+			if err != nil {
+				return nil, 0, err
+			}
+			dict[k] = v
+			n += size
+		}
+		if n == len(data) {
+			return nil, 0, ErrSyntax
+		}
+		return dict, n + 1, nil
+	default:
+		return decodeString(data)
+	}
+}
+
+func decodeString(data []byte) (string, int, error) {
+	colon := bytes.IndexByte(data, ':')
+	if colon < 1 {
+		return "", 0, ErrSyntax
+	}
+	length, err := strconv.Atoi(string(data[:colon]))
+	if err != nil || length < 0 || length > len(data)-colon-1 {
+		return "", 0, ErrSyntax
+	}
+	end := colon + 1 + length
+	return string(data[colon+1 : end]), end, nil
+}
@@ -0,0 +1,76 @@
+package bencode
+
+import (
+	"reflect"
+	"testing"
+	"zeroleaks/utils"
+)
+
+func TestMarshal(t *testing.T) {
+	for _, c := range []struct {
+		v        any
+		expected string
+	}{
+		{v: "spam", expected: "4:spam"},
+		{v: "", expected: "0:"},
+		{v: []byte{0, 1}, expected: "2:\x00\x01"},
+		{v: [2]byte{'a', 'b'}, expected: "2:ab"},
+		{v: 3, expected: "i3e"},
+		{v: -3, expected: "i-3e"},
+		{v: uint16(6881), expected: "i6881e"},
+		{v: []any{"spam", 42}, expected: "l4:spami42ee"},
+		{v: []any{}, expected: "le"},
+		{v: map[string]any{"spam": []string{"a", "b"}, "cow": "moo"}, expected: "d3:cow3:moo4:spaml1:a1:bee"},
+	} {
+		b, err := Marshal(c.v)
+		if err != nil {
+			utils.TErrorf(t, "Failed to encode %v: %s", c.v, err)
+		} else if string(b) != c.expected {
+			utils.TErrorf(t, "Invalid encoding of %v: got %q, expected %q", c.v, b, c.expected)
+		}
+	}
+	for _, v := range []any{nil, 1.5, map[int]int{1: 1}, []any{true}} {
+		if _, err := Marshal(v); err == nil {
+			utils.TErrorf(t, "Encoding of %v didn't fail", v)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	for _, c := range []struct {
+		data     string
+		expected any
+	}{
+		{data: "4:spam", expected: "spam"},
+		{data: "0:", expected: ""},
+		{data: "i-42e", expected: int64(-42)},
+		{data: "l4:spami42ee", expected: []any{"spam", int64(42)}},
+		{data: "le", expected: []any{}},
+		{data: "d3:cow3:moo4:spaml1:aee", expected: map[string]any{"cow": "moo", "spam": []any{"a"}}},
+	} {
+		v, err := Unmarshal([]byte(c.data))
+		if err != nil {
+			utils.TErrorf(t, "Failed to decode %q: %s", c.data, err)
+		} else if !reflect.DeepEqual(v, c.expected) {
+			utils.TErrorf(t, "Invalid decoding of %q: got %#v, expected %#v", c.data, v, c.expected)
+		}
+	}
+	for _, data := range []string{"", "i42", "ie", "ixe", "5:spam", "-1:", ":", "l4:spam", "d3:cowe", "di1ei2ee", "4:spamx", "x"} {
+		if v, err := Unmarshal([]byte(data)); err == nil {
+			utils.TErrorf(t, "Decoding of %q didn't fail: %#v", data, v)
+		}
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	f.Add([]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := Unmarshal(data)
+		if err != nil {
+			return
+		}
+		if _, err := Marshal(v); err != nil {
+			utils.TErrorf(t, "Failed to encode decoded value %#v: %s", v, err)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package bittorrent
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"zeroleaks/bencode"
+)
+
+// ServeHTTP handles the announce and scrape requests of the HTTP tracker
+// (BEP 3, BEP 23 and BEP 48). It reports clients to the same observers as the
+// UDP tracker.
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/announce":
+		t.handleHTTPAnnounce(w, r)
+	case "/scrape":
+		t.handleHTTPScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// httpPeer returns the client of r, or false if its address is invalid.
+func httpPeer(r *http.Request, request string) (Peer, bool) {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return Peer{}, false
+	}
+	peer := Peer{IP: net.ParseIP(host), Protocol: PROTOCOL_HTTP, Request: request}
+	peer.Port, _ = strconv.Atoi(port)
+	if r.TLS != nil {
+		peer.Protocol = PROTOCOL_HTTPS
+	}
+	return peer, peer.IP != nil
+}
+
+func writeBencode(w http.ResponseWriter, v map[string]any) {
+	b, err := bencode.Marshal(v)
+	if err != nil {
+		log.Printf("%s Error: failed to encode HTTP response: %s", TRACKER_LOG_TAG, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(b)
+}
+
+// failure reports an error to the client. As specified by BEP 3, it is sent
+// with a 200 status so that clients read it.
+func failure(w http.ResponseWriter, reason string) {
+	writeBencode(w, map[string]any{"failure reason": reason})
+}
+
+func (t *Tracker) handleHTTPAnnounce(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	infoHash := query.Get("info_hash")
+	if len(infoHash) != len(InfoHash{}) {
+		failure(w, "invalid info_hash")
+		return
+	}
+	peer, ok := httpPeer(r, REQUEST_ANNOUNCE)
+	if !ok {
+		log.Printf("%s Error: invalid remote address: %s", TRACKER_LOG_TAG, r.RemoteAddr)
+		failure(w, "invalid remote address")
+		return
+	}
+	peer.PeerID = query.Get("peer_id")
+	if port, err := strconv.ParseUint(query.Get("port"), 10, 16); err == nil {
+		peer.ListenPort = int(port)
+	}
+	peer.Key = query.Get("key")
+	peer.Event = query.Get("event")
+	t.Notify(InfoHash([]byte(infoHash)), peer)
+	response := map[string]any{
+		"interval":   INTERVAL_SECS,
+		"complete":   len(t.peers4) + len(t.peers6),
+		"incomplete": 0,
+	}
+	if query.Get("compact") == "1" {
+		response["peers"] = t.compactPeers(false)
+		if len(t.peers6) > 0 {
+			response["peers6"] = t.compactPeers(true)
+		}
+	} else {
+		peers := make([]any, 0, len(t.peers4)+len(t.peers6))
+		for _, ip := range slices.Concat(t.peers4, t.peers6) {
+			peers = append(peers, map[string]any{"peer id": peerId, "ip": ip.String(), "port": t.peerPort})
+		}
+		response["peers"] = peers
+	}
+	writeBencode(w, response)
+}
+
+func (t *Tracker) handleHTTPScrape(w http.ResponseWriter, r *http.Request) {
+	peer, ok := httpPeer(r, REQUEST_SCRAPE)
+	if !ok {
+		log.Printf("%s Error: invalid remote address: %s", TRACKER_LOG_TAG, r.RemoteAddr)
+		failure(w, "invalid remote address")
+		return
+	}
+	infoHashes := r.URL.Query()["info_hash"]
+	for _, infoHash := range infoHashes {
+		if len(infoHash) != len(InfoHash{}) {
+			failure(w, "invalid info_hash")
+			return
+		}
+	}
+	files := make(map[string]any)
+	for _, infoHash := range infoHashes[:min(len(infoHashes), MAX_SCRAPE_INFO_HASHES)] {
+		t.Notify(InfoHash([]byte(infoHash)), peer)
+		files[infoHash] = map[string]any{"complete": 0, "downloaded": 0, "incomplete": 0}
+	}
+	writeBencode(w, map[string]any{"files": files})
+}
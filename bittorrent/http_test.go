@@ -0,0 +1,88 @@
+package bittorrent
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"zeroleaks/utils"
+)
+
+func httpRequest(path string, query url.Values, t *testing.T) string {
+	r := httptest.NewRequest(http.MethodGet, path+"?"+query.Encode(), nil)
+	r.RemoteAddr = "192.0.2.1:6881"
+	w := httptest.NewRecorder()
+	tracker.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		utils.TFatalf(t, "Invalid response status for %s: %d", path, w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestHTTPAnnounce(t *testing.T) {
+	infoHash := InfoHash(utils.RandomBytes(20))
+	var peers []Peer
+	id, _ := tracker.RegisterCallback(infoHash, func(p Peer) {
+		peers = append(peers, p)
+	})
+	defer tracker.Unregister(infoHash, id)
+	port := strconv.Itoa(peerWireAddr.Port)
+	for _, c := range []struct {
+		compact  string
+		expected string
+	}{
+		{compact: "1", expected: "d8:completei2e10:incompletei0e8:intervali0e5:peers6:" + string(tracker.compactPeers(false)) + "6:peers618:" + string(tracker.compactPeers(true)) + "e"},
+		{compact: "0", expected: "d8:completei2e10:incompletei0e8:intervali0e5:peersld2:ip9:127.0.0.17:peer id20:" + peerId + "4:porti" + port + "eed2:ip3:::17:peer id20:" + peerId + "4:porti" + port + "eeee"},
+	} {
+		query := url.Values{
+			"info_hash": {string(infoHash[:])},
+			"peer_id":   {"-TR4000-abcdefghijkl"},
+			"port":      {"51413"},
+			"key":       {"1a2b3c"},
+			"event":     {"started"},
+			"compact":   {c.compact},
+		}
+		if res := httpRequest("/announce", query, t); res != c.expected {
+			utils.TErrorf(t, "Invalid announce response: got %q, expected %q", res, c.expected)
+		}
+	}
+	if len(peers) != 2 {
+		utils.TFatalf(t, "Callback called %d times, expected 2", len(peers))
+	}
+	p := peers[0]
+	if !p.IP.Equal(net.IPv4(192, 0, 2, 1)) || p.Port != 6881 || p.Protocol != PROTOCOL_HTTP || p.Request != REQUEST_ANNOUNCE {
+		utils.TErrorf(t, "Invalid announce request: %+v", p)
+	}
+	if p.ClientName() != "Transmission 4.0" || p.ListenPort != 51413 || p.Key != "1a2b3c" || p.Event != "started" {
+		utils.TErrorf(t, "Invalid announce fields: %s %d %s %s", p.ClientName(), p.ListenPort, p.Key, p.Event)
+	}
+
+	res := httpRequest("/announce", url.Values{"info_hash": {"short"}}, t)
+	if res != "d14:failure reason17:invalid info_hashe" {
+		utils.TErrorf(t, "Invalid failure response: %q", res)
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	infoHash := InfoHash(utils.RandomBytes(20))
+	unknownInfoHash := InfoHash(utils.RandomBytes(20))
+	var peer Peer
+	id, _ := tracker.RegisterCallback(infoHash, func(p Peer) {
+		peer = p
+	})
+	defer tracker.Unregister(infoHash, id)
+	res := httpRequest("/scrape", url.Values{"info_hash": {string(infoHash[:]), string(unknownInfoHash[:])}}, t)
+	stats := "d8:completei0e10:downloadedi0e10:incompletei0ee"
+	files := "20:" + string(infoHash[:]) + stats + "20:" + string(unknownInfoHash[:]) + stats
+	if string(infoHash[:]) > string(unknownInfoHash[:]) {
+		files = "20:" + string(unknownInfoHash[:]) + stats + "20:" + string(infoHash[:]) + stats
+	}
+	if expected := "d5:filesd" + files + "ee"; res != expected {
+		utils.TErrorf(t, "Invalid scrape response: got %q, expected %q", res, expected)
+	}
+	if peer.Request != REQUEST_SCRAPE || peer.Protocol != PROTOCOL_HTTP || !peer.IP.Equal(net.IPv4(192, 0, 2, 1)) {
+		utils.TErrorf(t, "Invalid scrape request: %+v", peer)
+	}
+}
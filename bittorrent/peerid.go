@@ -0,0 +1,109 @@
+package bittorrent
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Client codes of Azureus-style peer IDs, such as "-qB4620-".
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FX": "Freebox BitTorrent",
+	"KT": "KTorrent",
+	"LT": "libtorrent (Rakshasa)",
+	"lt": "libTorrent (Rasterbar)",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"TX": "Tixati",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+	"ZL": "ZeroLeaks",
+}
+
+// Client codes of Shadow-style peer IDs, such as "S58B-----".
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+const shadowDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// ParsePeerID returns the name and version of the client which generated
+// id. ok is false if the style of id is unknown.
+func ParsePeerID(id string) (client string, version string, ok bool) {
+	if len(id) >= 8 && id[0] == '-' && id[7] == '-' {
+		client, ok = azureusClients[id[1:3]]
+		if !ok {
+			return "", "", false
+		}
+		var parts []string
+		for _, c := range id[3:7] {
+			v, err := strconv.ParseUint(string(c), 36, 8)
+			if err != nil {
+				return client, "", true
+			}
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+		// "4620" is version 4.6.2
+		for len(parts) > 2 && parts[len(parts)-1] == "0" {
+			parts = parts[:len(parts)-1]
+		}
+		return client, strings.Join(parts, "."), true
+	}
+	if len(id) >= 7 {
+		client, ok = shadowClients[id[0]]
+		if !ok {
+			return "", "", false
+		}
+		// up to 5 version digits, followed by dashes
+		var parts []string
+		end := strings.Index(id[1:6], "-")
+		if end < 0 {
+			end = 5
+		}
+		if end == 0 || strings.Trim(id[1+end:6], "-") != "" || (end == 5 && id[6] != '-') {
+			return "", "", false
+		}
+		for _, c := range []byte(id[1 : 1+end]) {
+			v := strings.IndexByte(shadowDigits, c)
+			if v < 0 {
+				return "", "", false
+			}
+			parts = append(parts, strconv.Itoa(v))
+		}
+		return client, strings.Join(parts, "."), true
+	}
+	return "", "", false
+}
+
+// ClientName returns the client advertised in the extension handshake of p,
+// or else the client identified by its peer ID, with its version.
+func (p *Peer) ClientName() string {
+	if p.Client != "" {
+		return p.Client
+	}
+	client, version, ok := ParsePeerID(p.PeerID)
+	if !ok {
+		return ""
+	}
+	if version == "" {
+		return client
+	}
+	return client + " " + version
+}
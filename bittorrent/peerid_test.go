@@ -0,0 +1,41 @@
+package bittorrent
+
+import (
+	"testing"
+	"zeroleaks/utils"
+)
+
+func TestParsePeerID(t *testing.T) {
+	for _, c := range []struct {
+		id      string
+		client  string
+		version string
+		ok      bool
+	}{
+		{id: "-qB4620-" + "abcdefghijkl", client: "qBittorrent", version: "4.6.2", ok: true},
+		{id: "-TR4000-" + "abcdefghijkl", client: "Transmission", version: "4.0", ok: true},
+		{id: "-lt0D60-" + "abcdefghijkl", client: "libTorrent (Rasterbar)", version: "0.13.6", ok: true},
+		{id: "-UT355W-" + "abcdefghijkl", client: "µTorrent", version: "3.5.5.32", ok: true},
+		{id: "-UT35!!-" + "abcdefghijkl", client: "µTorrent", version: "", ok: true},
+		{id: "S58B-----" + "abcdefghijk", client: "Shadow", version: "5.8.11", ok: true},
+		{id: "T03I--00" + "abcdefghijkl", client: "BitTornado", version: "0.3.18", ok: true},
+		{id: "-XX1000-" + "abcdefghijkl"},
+		{id: "S58B-x---" + "abcdefghijk"},
+		{id: "M4-3-6--" + "abcdefghijkl"},
+		{id: "T-"},
+		{id: ""},
+	} {
+		client, version, ok := ParsePeerID(c.id)
+		if client != c.client || version != c.version || ok != c.ok {
+			utils.TErrorf(t, "Invalid parsing of %q: got %q %q %t, expected %q %q %t", c.id, client, version, ok, c.client, c.version, c.ok)
+		}
+	}
+	p := Peer{PeerID: "-qB4620-abcdefghijkl"}
+	if name := p.ClientName(); name != "qBittorrent 4.6.2" {
+		utils.TErrorf(t, "Invalid client name: %q", name)
+	}
+	p.Client = "qBittorrent/4.6.2"
+	if name := p.ClientName(); name != "qBittorrent/4.6.2" {
+		utils.TErrorf(t, "Invalid client name: %q", name)
+	}
+}
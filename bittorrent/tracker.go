@@ -2,13 +2,20 @@ package bittorrent
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
-	"math/rand"
 	"net"
+	"net/http"
+	"sync"
 	"time"
+	"zeroleaks/registry"
+	"zeroleaks/utils"
 
-	"github.com/jellydator/ttlcache/v3"
+	"github.com/coder/websocket"
 	"github.com/lunixbochs/struc"
 )
 
@@ -22,16 +29,79 @@ const (
 	CONNECT_RESPONSE_SIZE  = 16
 	ANNONCE_REQUEST_SIZE   = 98
 	ANNOUNCE_RESPONSE_SIZE = 20
+	SCRAPE_HEADER_SIZE     = 16
+	SCRAPE_RESPONSE_SIZE   = 8
+	SCRAPE_STATS_SIZE      = 12
+	ERROR_RESPONSE_SIZE    = 8
+	// BEP 15 limits scrapes to 74 info hashes so that responses fit in a
+	// single packet.
+	MAX_SCRAPE_INFO_HASHES = 74
 
 	ACTION_CONNECT  = 0
 	ACTION_ANNOUNCE = 1
 	ACTION_SCRAPE   = 2
+	ACTION_ERROR    = 3
+
+	// option types of announce requests (BEP 41)
+	OPTION_END_OF_OPTIONS = 0
+	OPTION_NOP            = 1
+	OPTION_URL_DATA       = 2
+
+	// Connection IDs are valid during the period in which they are
+	// issued and the next one, so for one to two minutes as required by
+	// BEP 15.
+	CONNECTION_ID_PERIOD = time.Minute
+
+	PROTOCOL_UDP   = "udp"
+	PROTOCOL_HTTP  = "http"
+	PROTOCOL_HTTPS = "https"
+	PROTOCOL_DHT   = "dht"
+	// TCP connections between peers (BEP 3)
+	PROTOCOL_PEER_WIRE = "peer_wire"
 )
 
-var RESEND_CONNECT_RESPONSE_DELAY = 500
+// Requests through which a client can reveal its IP.
+const (
+	REQUEST_ANNOUNCE      = "announce"
+	REQUEST_SCRAPE        = "scrape"
+	REQUEST_GET_PEERS     = "get_peers"
+	REQUEST_ANNOUNCE_PEER = "announce_peer"
+	REQUEST_HANDSHAKE     = "handshake"
+)
 
 type InfoHash [20]byte
 
+// Peer describes a client which contacted the tracker or the DHT node about a
+// registered info hash.
+type Peer struct {
+	IP       net.IP
+	Port     int
+	Protocol string
+	// Request is one of the REQUEST_* constants.
+	Request string
+	// URLData is the path and query of the tracker URL, sent by UDP clients
+	// in announce options (BEP 41). It can carry a session token.
+	URLData string
+	// Set by announces and peer-wire connections.
+	PeerID string
+	// ListenPort is the port on which the client accepts peer connections,
+	// as announced or advertised in its extension handshake.
+	ListenPort int
+	// Set by announces.
+	Key   string
+	Event string
+	// Set by peer-wire connections.
+	Reserved [8]byte
+	// Set if the client sent an extension handshake (BEP 10).
+	Client string
+	YourIP net.IP
+	// Set by WebRTC candidates: host, srflx, prflx or relay.
+	Candidate string
+}
+
+// Events of UDP announces.
+var announceEvents = []string{"", "completed", "started", "stopped"}
+
 type ConnectRequest struct {
 	ProtocolId    int64
 	Action        int32
@@ -68,10 +138,49 @@ type AnnounceResponse struct {
 	Seeders       int32
 }
 
+type ScrapeRequest struct {
+	ConnectionId  uint64
+	Action        int32
+	TransactionId uint32
+}
+
+type ScrapeResponse struct {
+	Action        int32
+	TransactionId uint32
+}
+
+// ErrorResponse is followed by an error message.
+type ErrorResponse struct {
+	Action        int32
+	TransactionId uint32
+}
+
+// ScrapeStats follows ScrapeResponse for every info hash scraped.
+type ScrapeStats struct {
+	Seeders   int32
+	Completed int32
+	Leechers  int32
+}
+
 type Tracker struct {
-	udpServer  net.PacketConn
-	responses  map[uint64]chan bool
-	infoHashes *ttlcache.Cache[InfoHash, func(net.IP)]
+	udpServer net.PacketConn
+	// secret authenticates connection IDs, along with the period in which
+	// they were issued.
+	secret     []byte
+	infoHashes *registry.Registry[InfoHash, Peer, struct{}]
+	// peers4 and peers6 are the addresses returned in announce responses,
+	// along with peerPort, so that clients connect to the peer-wire server.
+	peers4   []net.IP
+	peers6   []net.IP
+	peerPort int
+	dhtPort  int
+	// swarms holds the connections of the WebTorrent clients by info hash
+	// and peer ID, through which offers and answers are relayed.
+	swarmsMutex sync.Mutex
+	swarms      map[InfoHash]map[string]*websocket.Conn
+	// clientAddr returns the address and port of the WebTorrent client of a
+	// request.
+	clientAddr func(r *http.Request) (net.IP, int)
 }
 
 func NewTracker(addr string, timeout time.Duration) (*Tracker, int, error) {
@@ -80,31 +189,85 @@ func NewTracker(addr string, timeout time.Duration) (*Tracker, int, error) {
 		return nil, -1, err
 	}
 	tracker := Tracker{
-		udpServer: server,
-		responses: make(map[uint64]chan bool),
-		infoHashes: ttlcache.New(
-			ttlcache.WithTTL[InfoHash, func(net.IP)](timeout),
-			ttlcache.WithDisableTouchOnHit[InfoHash, func(net.IP)](),
-		),
-	}
-	go tracker.infoHashes.Start()
+		udpServer:  server,
+		secret:     utils.RandomBytes(32),
+		infoHashes: registry.New[InfoHash, Peer, struct{}](timeout),
+		swarms:     make(map[InfoHash]map[string]*websocket.Conn),
+		clientAddr: remoteAddr,
+	}
 	return &tracker, server.LocalAddr().(*net.UDPAddr).Port, nil
 }
 
-func (t *Tracker) RegisterCallback(k InfoHash, f func(net.IP)) {
-	t.infoHashes.Set(k, f, ttlcache.DefaultTTL)
+// RegisterCallback adds f to the observers of the info hash k. inUse is true
+// if k was already registered.
+func (t *Tracker) RegisterCallback(k InfoHash, f func(Peer)) (id uint64, inUse bool) {
+	return t.infoHashes.Register(k, struct{}{}, f)
+}
+
+func (t *Tracker) Unregister(k InfoHash, id uint64) {
+	t.infoHashes.Unregister(k, id)
+}
+
+// SetPeers makes the tracker return ips, with port, as the peers of every
+// torrent. It must be called before the tracker starts.
+func (t *Tracker) SetPeers(ips []net.IP, port int) {
+	t.peers4, t.peers6 = nil, nil
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			t.peers4 = append(t.peers4, ip4)
+		} else {
+			t.peers6 = append(t.peers6, ip.To16())
+		}
+	}
+	t.peerPort = port
+}
+
+// SetDHTPort sets the port of the DHT node, advertised to the clients
+// connecting to the peer-wire server. It must be called before the tracker
+// starts.
+func (t *Tracker) SetDHTPort(port int) {
+	t.dhtPort = port
+}
+
+// peers returns the IPv6 peers if ipv6 is true, the IPv4 ones otherwise.
+func (t *Tracker) peers(ipv6 bool) []net.IP {
+	if ipv6 {
+		return t.peers6
+	}
+	return t.peers4
+}
+
+// compactPeers returns the peers of an address family in the compact format:
+// 6 bytes per IPv4 peer (BEP 23) or 18 bytes per IPv6 peer (BEP 7).
+func (t *Tracker) compactPeers(ipv6 bool) []byte {
+	var buff []byte
+	for _, ip := range t.peers(ipv6) {
+		buff = append(buff, ip...)
+		buff = binary.BigEndian.AppendUint16(buff, uint16(t.peerPort))
+	}
+	return buff
+}
+
+// Notify reports p to the observers of k. It allows other subsystems, such as
+// the DHT node, to share the observers of the tracker.
+func (t *Tracker) Notify(k InfoHash, p Peer) {
+	t.infoHashes.Notify(k, p)
 }
 
 func (t *Tracker) reply(dst net.Addr, response interface{}, size int) {
 	buff := bytes.NewBuffer(make([]byte, 0, size))
 	struc.Pack(buff, response)
-	n, err := t.udpServer.WriteTo(buff.Bytes(), dst)
+	t.send(dst, buff.Bytes())
+}
+
+func (t *Tracker) send(dst net.Addr, packet []byte) {
+	n, err := t.udpServer.WriteTo(packet, dst)
 	if err != nil {
 		log.Printf("%s Error while sending UDP packet to %s: %s", TRACKER_LOG_TAG, dst, err)
 		return
 	}
-	if n != size {
-		log.Printf("%s Error: Incorrect amount of bytes sent to %s: written %d instead of %d", TRACKER_LOG_TAG, dst, n, size)
+	if n != len(packet) {
+		log.Printf("%s Error: Incorrect amount of bytes sent to %s: written %d instead of %d", TRACKER_LOG_TAG, dst, n, len(packet))
 		return
 	}
 }
@@ -123,34 +286,75 @@ func (t *Tracker) handleConnect(src net.Addr, buff []byte) {
 	if connectRequest.ProtocolId != PROTOCOL_ID {
 		log.Printf("%s Warning: unkown protocol_id received from %s: %x", TRACKER_LOG_TAG, src, connectRequest.ProtocolId)
 	}
-	connectionId := rand.Uint64()
 	connectResponse := ConnectResponse{
 		Action:        ACTION_CONNECT,
 		TransactionId: connectRequest.TransactionId,
-		ConnectionId:  connectionId,
-	}
-	ch := make(chan bool)
-	t.responses[connectionId] = ch
-	go func() {
-		for range 60 {
-			t.reply(src, &connectResponse, CONNECT_RESPONSE_SIZE)
-			time.Sleep(time.Millisecond * time.Duration(RESEND_CONNECT_RESPONSE_DELAY))
-			stop := false
-			select {
-			case _ = <-ch:
-				stop = true
-			default:
+		ConnectionId:  t.connectionId(src.(*net.UDPAddr), connectionIdEpoch(time.Now())),
+	}
+	t.reply(src, &connectResponse, CONNECT_RESPONSE_SIZE)
+}
+
+func connectionIdEpoch(now time.Time) int64 {
+	return now.UnixNano() / int64(CONNECTION_ID_PERIOD)
+}
+
+// connectionId returns the connection ID of a client with address src in the
+// period epoch. It can't be guessed by clients spoofing src.
+func (t *Tracker) connectionId(src *net.UDPAddr, epoch int64) uint64 {
+	mac := hmac.New(sha256.New, t.secret)
+	binary.Write(mac, binary.BigEndian, epoch)
+	mac.Write(src.IP.To16())
+	binary.Write(mac, binary.BigEndian, uint16(src.Port))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (t *Tracker) validConnectionId(src net.Addr, connectionId uint64) bool {
+	epoch := connectionIdEpoch(time.Now())
+	udpAddr := src.(*net.UDPAddr)
+	return connectionId == t.connectionId(udpAddr, epoch) || connectionId == t.connectionId(udpAddr, epoch-1)
+}
+
+// replyError sends an error response (BEP 15) with msg to dst.
+func (t *Tracker) replyError(dst net.Addr, transactionId uint32, msg string) {
+	response := bytes.NewBuffer(make([]byte, 0, ERROR_RESPONSE_SIZE+len(msg)))
+	struc.Pack(response, &ErrorResponse{Action: ACTION_ERROR, TransactionId: transactionId})
+	response.WriteString(msg)
+	t.send(dst, response.Bytes())
+}
+
+func udpPeer(src net.Addr, request string) Peer {
+	udpAddr := src.(*net.UDPAddr)
+	return Peer{IP: udpAddr.IP, Port: udpAddr.Port, Protocol: PROTOCOL_UDP, Request: request}
+}
+
+// parseURLData returns the concatenation of the URL data options (BEP 41)
+// found in the options following an announce request.
+func parseURLData(options []byte) (string, error) {
+	var data []byte
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case OPTION_END_OF_OPTIONS:
+			return string(data), nil
+		case OPTION_NOP:
+			i++
+		default:
+			// unknown options have a length too, so they can be skipped
+			if i+1 >= len(options) || i+2+int(options[i+1]) > len(options) {
+				return "", errors.New("truncated option")
 			}
-			if stop {
-				break
+			if options[i] == OPTION_URL_DATA {
+				data = append(data, options[i+2:i+2+int(options[i+1])]...)
 			}
+			i += 2 + int(options[i+1])
 		}
-	}()
+	}
+	return string(data), nil
 }
 
-func (t *Tracker) handleAnnounce(src net.Addr, buff []byte) {
-	if len(buff) < CONNECT_REQUEST_SIZE {
+func (t *Tracker) handleAnnounce(src net.Addr, transactionId uint32, buff []byte) {
+	if len(buff) < ANNONCE_REQUEST_SIZE {
 		log.Printf("%s Error: incomplete announce request size received from %s: %d", TRACKER_LOG_TAG, src, len(buff))
+		t.replyError(src, transactionId, "invalid packet size")
 		return
 	}
 	var announceRequest AnnounceRequest
@@ -159,15 +363,22 @@ func (t *Tracker) handleAnnounce(src net.Addr, buff []byte) {
 		log.Printf("%s Error: failed to unpack announce request from %s: %s", TRACKER_LOG_TAG, src, err)
 		return
 	}
-	if ch, ok := t.responses[announceRequest.ConnectionId]; ok {
-		ch <- true
-		delete(t.responses, announceRequest.ConnectionId)
+	peer := udpPeer(src, REQUEST_ANNOUNCE)
+	peer.URLData, err = parseURLData(buff[ANNONCE_REQUEST_SIZE:])
+	if err != nil {
+		log.Printf("%s Warning: invalid announce options received from %s: %s", TRACKER_LOG_TAG, src, err)
 	}
-	entry := t.infoHashes.Get(announceRequest.InfoHash)
-	if entry != nil {
-		entry.Value()(src.(*net.UDPAddr).IP)
+	peer.PeerID = string(announceRequest.PeerId[:])
+	peer.ListenPort = int(announceRequest.Port)
+	peer.Key = fmt.Sprintf("%08x", announceRequest.Key)
+	if announceRequest.Event >= 0 && int(announceRequest.Event) < len(announceEvents) {
+		peer.Event = announceEvents[announceRequest.Event]
 	}
-	if announceRequest.IPAddress != 0 {
+	t.Notify(announceRequest.InfoHash, peer)
+	// BEP 15: IPv6 clients get IPv6 peers, and their IP address field is
+	// meaningless
+	ipv6 := src.(*net.UDPAddr).IP.To4() == nil
+	if announceRequest.IPAddress != 0 && !ipv6 {
 		ip := make(net.IP, 4)
 		binary.BigEndian.PutUint32(ip, announceRequest.IPAddress)
 		log.Printf("%s Warning: IP address field not supported. %s set it to: %s:%d", TRACKER_LOG_TAG, src, ip, announceRequest.Port)
@@ -177,33 +388,75 @@ func (t *Tracker) handleAnnounce(src net.Addr, buff []byte) {
 		TransactionId: announceRequest.TransactionId,
 		Interval:      INTERVAL_SECS,
 		Leechers:      0,
-		Seeders:       0,
+		Seeders:       int32(len(t.peers(ipv6))),
 	}
-	t.reply(src, &announceResponse, ANNOUNCE_RESPONSE_SIZE)
+	peers := t.compactPeers(ipv6)
+	response := bytes.NewBuffer(make([]byte, 0, ANNOUNCE_RESPONSE_SIZE+len(peers)))
+	struc.Pack(response, &announceResponse)
+	response.Write(peers)
+	t.send(src, response.Bytes())
+}
+
+func (t *Tracker) handleScrape(src net.Addr, transactionId uint32, buff []byte) {
+	if len(buff) < SCRAPE_HEADER_SIZE+len(InfoHash{}) {
+		log.Printf("%s Error: incomplete scrape request size received from %s: %d", TRACKER_LOG_TAG, src, len(buff))
+		t.replyError(src, transactionId, "invalid packet size")
+		return
+	}
+	var scrapeRequest ScrapeRequest
+	err := struc.Unpack(bytes.NewBuffer(buff), &scrapeRequest)
+	if err != nil {
+		log.Printf("%s Error: failed to unpack scrape request from %s: %s", TRACKER_LOG_TAG, src, err)
+		return
+	}
+	n := min((len(buff)-SCRAPE_HEADER_SIZE)/len(InfoHash{}), MAX_SCRAPE_INFO_HASHES)
+	for i := range n {
+		offset := SCRAPE_HEADER_SIZE + i*len(InfoHash{})
+		t.Notify(InfoHash(buff[offset:offset+len(InfoHash{})]), udpPeer(src, REQUEST_SCRAPE))
+	}
+	// the torrents are reported empty, as in announce responses
+	size := SCRAPE_RESPONSE_SIZE + n*SCRAPE_STATS_SIZE
+	response := bytes.NewBuffer(make([]byte, 0, size))
+	struc.Pack(response, &ScrapeResponse{Action: ACTION_SCRAPE, TransactionId: scrapeRequest.TransactionId})
+	for range n {
+		struc.Pack(response, &ScrapeStats{})
+	}
+	t.send(src, response.Bytes())
 }
 
 func (t *Tracker) Start() {
-	buff := make([]byte, max(CONNECT_REQUEST_SIZE, ANNONCE_REQUEST_SIZE))
+	buff := make([]byte, SCRAPE_HEADER_SIZE+MAX_SCRAPE_INFO_HASHES*len(InfoHash{}))
 	for {
 		n, src, err := t.udpServer.ReadFrom(buff)
 		if err != nil {
 			log.Printf("%s Error while reading UDP packet from %s: %s", TRACKER_LOG_TAG, src, err)
 			continue
 		}
-		if n < 12 {
+		// every request starts with a 16 bytes header, without which no
+		// error can be sent back
+		if n < CONNECT_REQUEST_SIZE {
 			log.Printf("%s Error: invalid packet size received from %s: %d", TRACKER_LOG_TAG, src, n)
 			continue
 		}
 		action := binary.BigEndian.Uint32(buff[8:12])
+		transactionId := binary.BigEndian.Uint32(buff[12:16])
+		// requests other than connect must carry the connection ID of
+		// their source. Others are dropped without any response, which
+		// would otherwise be reflected to spoofed sources.
+		if action != ACTION_CONNECT && !t.validConnectionId(src, binary.BigEndian.Uint64(buff[:8])) {
+			log.Printf("%s Error: invalid connection id received from %s", TRACKER_LOG_TAG, src)
+			continue
+		}
 		switch action {
 		case ACTION_CONNECT:
 			t.handleConnect(src, buff[:n])
 		case ACTION_ANNOUNCE:
-			t.handleAnnounce(src, buff[:n])
+			t.handleAnnounce(src, transactionId, buff[:n])
 		case ACTION_SCRAPE:
-			// not implemented
+			t.handleScrape(src, transactionId, buff[:n])
 		default:
 			log.Printf("%s Error: invalid action received from %s: %x", TRACKER_LOG_TAG, src, action)
+			t.replyError(src, transactionId, "unknown action")
 		}
 	}
 }
@@ -13,14 +13,17 @@ import (
 	"github.com/lunixbochs/struc"
 )
 
+// the tracker listens on all addresses, on both IPv4 and IPv6
+const listenAddr = ":31337"
 const addr = "127.0.0.1:31337"
+const addr6 = "[::1]:31337"
 const timeout = time.Millisecond * 100
 
 var tracker *Tracker
+var peerWireAddr *net.TCPAddr
 
 func TestMain(m *testing.M) {
-	RESEND_CONNECT_RESPONSE_DELAY = 10
-	t, _, err := NewTracker(addr, timeout)
+	t, _, err := NewTracker(listenAddr, timeout)
 	// Fuzzing spawns several processes in parallel. Consequently,
 	// the tracker server will not be able to listen to on the same UDP port
 	// if another process has already bound to it earlier. In the case of an
@@ -30,6 +33,14 @@ func TestMain(m *testing.M) {
 	// the tracker server and so we are in charge to start it.
 	if err == nil {
 		tracker = t
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			panic(err)
+		}
+		peerWireAddr = l.Addr().(*net.TCPAddr)
+		tracker.SetPeers([]net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, peerWireAddr.Port)
+		tracker.SetDHTPort(6881)
+		go tracker.ServePeerWire(l)
 		go tracker.Start()
 		time.Sleep(10 * time.Millisecond) // wait for the tracker to start
 	}
@@ -46,7 +57,7 @@ func send(c net.Conn, buff []byte, name string, t *testing.T) {
 	}
 }
 
-func connect(t *testing.T) net.Conn {
+func connect(addr string, t *testing.T) net.Conn {
 	c, err := net.Dial("udp", addr)
 	if err != nil {
 		utils.TFatalf(t, "Cannot connect to the tracker: %s", err)
@@ -57,10 +68,10 @@ func connect(t *testing.T) net.Conn {
 func FuzzRandomPacket(f *testing.F) {
 	f.Add([]byte{})
 	f.Fuzz(func(t *testing.T, packet []byte) {
-		c := connect(t)
+		c := connect(addr, t)
 		if len(packet) >= 12 {
 			// insert valid action
-			binary.BigEndian.PutUint32(packet[8:], uint32(rand.Intn(2)))
+			binary.BigEndian.PutUint32(packet[8:], uint32(rand.Intn(3)))
 		}
 		send(c, packet, "random packet", t)
 		if err := c.Close(); err != nil {
@@ -70,18 +81,136 @@ func FuzzRandomPacket(f *testing.F) {
 }
 
 func TestTracker(t *testing.T) {
-	infoHash := InfoHash(utils.RandomBytes(20))
-	var requestIp net.IP
-	tracker.RegisterCallback(infoHash, func(ip net.IP) {
-		requestIp = ip
-	})
-	unknownInfoHash := InfoHash(utils.RandomBytes(20))
-	tracker.RegisterCallback(unknownInfoHash, func(ip net.IP) {
-		utils.TErrorf(t, "Callback for info hash %x unexpectedly called with IP %s", unknownInfoHash, ip)
-	})
+	for _, a := range []struct {
+		addr     string
+		ip       net.IP
+		peerSize int
+	}{
+		{addr: addr, ip: net.IPv4(127, 0, 0, 1), peerSize: 6},
+		{addr: addr6, ip: net.IPv6loopback, peerSize: 18},
+	} {
+		infoHash := InfoHash(utils.RandomBytes(20))
+		reported := make(chan Peer, 1)
+		tracker.RegisterCallback(infoHash, func(p Peer) {
+			reported <- p
+		})
+		id, inUse := tracker.RegisterCallback(infoHash, func(p Peer) {
+			utils.TErrorf(t, "Unregistered callback called with IP %s", p.IP)
+		})
+		if !inUse {
+			utils.TErrorf(t, "Info hash %x not reported in use", infoHash)
+		}
+		tracker.Unregister(infoHash, id)
+		unknownInfoHash := InfoHash(utils.RandomBytes(20))
+		tracker.RegisterCallback(unknownInfoHash, func(p Peer) {
+			utils.TErrorf(t, "Callback for info hash %x unexpectedly called with IP %s", unknownInfoHash, p.IP)
+		})
 
-	c := connect(t)
-	// sending connect request
+		c := connect(a.addr, t)
+		// sending connect request
+		trId := rand.Uint32()
+		sendBuff := bytes.NewBuffer(make([]byte, 0, CONNECT_REQUEST_SIZE))
+		if err := struc.Pack(sendBuff, &ConnectRequest{
+			ProtocolId:    PROTOCOL_ID,
+			Action:        ACTION_CONNECT,
+			TransactionId: trId,
+		}); err != nil {
+			utils.TFatalf(t, "Failed to pack connect request: %s", err)
+		}
+		send(c, sendBuff.Bytes(), "connect request", t)
+		// receiving connect response
+		recvBuff := make([]byte, max(CONNECT_RESPONSE_SIZE, ANNOUNCE_RESPONSE_SIZE+18))
+		n, err := c.Read(recvBuff)
+		if err != nil {
+			utils.TFatalf(t, "Failed to read connect response: %s", err)
+		}
+		if n != CONNECT_RESPONSE_SIZE {
+			utils.TErrorf(t, "Unexpected connect response size: received %d bytes, expected %d", n, CONNECT_RESPONSE_SIZE)
+		}
+		var connectResponse ConnectResponse
+		if err := struc.Unpack(bytes.NewBuffer(recvBuff), &connectResponse); err != nil {
+			utils.TFatalf(t, "Failed to unpack connect response: %s", err)
+		}
+		if connectResponse.Action != ACTION_CONNECT {
+			utils.TErrorf(t, "Invalid connect response action: received %x, expected %x", connectResponse.Action, ACTION_CONNECT)
+		}
+		if connectResponse.TransactionId != trId {
+			utils.TErrorf(t, "Incorrect transaction_id received: %d, expected %d", connectResponse.TransactionId, trId)
+		}
+		// sending announce request
+		trId = rand.Uint32()
+		sendBuff.Reset()
+		if err := struc.Pack(sendBuff, &AnnounceRequest{
+			ConnectionId:  connectResponse.ConnectionId,
+			Action:        ACTION_ANNOUNCE,
+			TransactionId: trId,
+			InfoHash:      infoHash,
+			PeerId:        [20]byte([]byte("-qB4620-abcdefghijkl")),
+			Event:         2,
+			Key:           0xbadcafe,
+			Port:          51413,
+		}); err != nil {
+			utils.TFatalf(t, "Failed to pack announce request: %s", err)
+		}
+		sendBuff.Write([]byte{OPTION_URL_DATA, 5, '/', 'a', 'b', 'c', 'd', OPTION_NOP, OPTION_URL_DATA, 6, '?', 'x', '=', '1', '2', '3', OPTION_END_OF_OPTIONS})
+		send(c, sendBuff.Bytes(), "announce request", t)
+		// receiving announce response
+		n, err = c.Read(recvBuff)
+		if err != nil {
+			utils.TFatalf(t, "Failed to read announce response: %s", err)
+		}
+		if n != ANNOUNCE_RESPONSE_SIZE+a.peerSize {
+			utils.TErrorf(t, "Unexpected announce response size: received %d bytes, expected %d", n, ANNOUNCE_RESPONSE_SIZE+a.peerSize)
+		}
+		var announceResponse AnnounceResponse
+		if err = struc.Unpack(bytes.NewBuffer(recvBuff), &announceResponse); err != nil {
+			utils.TFatalf(t, "Failed to unpack announce response: %s", err)
+		}
+		if announceResponse.Action != ACTION_ANNOUNCE {
+			utils.TErrorf(t, "Invalid announce response action: received %x, expected %x", announceResponse.Action, ACTION_ANNOUNCE)
+		}
+		if announceResponse.TransactionId != trId {
+			utils.TErrorf(t, "Incorrect transaction_id received: %d, expected %d", announceResponse.TransactionId, trId)
+		}
+		if announceResponse.Seeders != 1 || !bytes.Equal(recvBuff[ANNOUNCE_RESPONSE_SIZE:n], tracker.compactPeers(a.peerSize == 18)) {
+			utils.TErrorf(t, "Invalid peers returned: %d %x", announceResponse.Seeders, recvBuff[ANNOUNCE_RESPONSE_SIZE:n])
+		}
+
+		var peer Peer
+		select {
+		case peer = <-reported:
+		case <-time.After(time.Second):
+			utils.TFatalf(t, "Announce not reported")
+		}
+		if peer.Request != REQUEST_ANNOUNCE {
+			utils.TErrorf(t, "Invalid request: %s", peer.Request)
+		}
+		if peer.URLData != "/abcd?x=123" {
+			utils.TErrorf(t, "Invalid URL data: %q", peer.URLData)
+		}
+		if peer.ClientName() != "qBittorrent 4.6.2" || peer.ListenPort != 51413 || peer.Key != "0badcafe" || peer.Event != "started" {
+			utils.TErrorf(t, "Invalid announce fields: %s %d %s %s", peer.ClientName(), peer.ListenPort, peer.Key, peer.Event)
+		}
+		if !peer.IP.Equal(a.ip) {
+			utils.TErrorf(t, "Invalid request IP: %s", peer.IP)
+		}
+		if peer.Port != c.LocalAddr().(*net.UDPAddr).Port || peer.Protocol != PROTOCOL_UDP {
+			utils.TErrorf(t, "Invalid request source: %d/%s", peer.Port, peer.Protocol)
+		}
+	}
+}
+
+func TestScrape(t *testing.T) {
+	infoHashes := []InfoHash{InfoHash(utils.RandomBytes(20)), InfoHash(utils.RandomBytes(20)), InfoHash(utils.RandomBytes(20))}
+	scraped := make(map[InfoHash]Peer)
+	for _, infoHash := range infoHashes[:2] {
+		id, _ := tracker.RegisterCallback(infoHash, func(p Peer) {
+			scraped[infoHash] = p
+		})
+		defer tracker.Unregister(infoHash, id)
+	}
+
+	c := connect(addr, t)
 	trId := rand.Uint32()
 	sendBuff := bytes.NewBuffer(make([]byte, 0, CONNECT_REQUEST_SIZE))
 	if err := struc.Pack(sendBuff, &ConnectRequest{
@@ -92,32 +221,66 @@ func TestTracker(t *testing.T) {
 		utils.TFatalf(t, "Failed to pack connect request: %s", err)
 	}
 	send(c, sendBuff.Bytes(), "connect request", t)
-	// receiving connect response
-	recvBuff := make([]byte, max(CONNECT_RESPONSE_SIZE, ANNOUNCE_RESPONSE_SIZE))
-	for range 6 { // simulate 5 packets drop
-		n, err := c.Read(recvBuff)
-		if err != nil {
-			utils.TFatalf(t, "Failed to read connect response: %s", err)
-		}
-		if n != CONNECT_RESPONSE_SIZE {
-			utils.TErrorf(t, "Unexpected connect response size: received %d bytes, expected %d", n, CONNECT_RESPONSE_SIZE)
-		}
+	recvBuff := make([]byte, SCRAPE_RESPONSE_SIZE+len(infoHashes)*SCRAPE_STATS_SIZE)
+	if _, err := c.Read(recvBuff); err != nil {
+		utils.TFatalf(t, "Failed to read connect response: %s", err)
 	}
 	var connectResponse ConnectResponse
 	if err := struc.Unpack(bytes.NewBuffer(recvBuff), &connectResponse); err != nil {
 		utils.TFatalf(t, "Failed to unpack connect response: %s", err)
 	}
-	if connectResponse.Action != ACTION_CONNECT {
-		utils.TErrorf(t, "Invalid connect response action: received %x, expected %x", connectResponse.Action, ACTION_CONNECT)
-	}
-	if connectResponse.TransactionId != trId {
-		utils.TErrorf(t, "Incorrect transaction_id received: %d, expected %d", connectResponse.TransactionId, trId)
-	}
-	// sending announce request
+
 	trId = rand.Uint32()
 	sendBuff.Reset()
-	if err := struc.Pack(sendBuff, &AnnounceRequest{
+	if err := struc.Pack(sendBuff, &ScrapeRequest{
 		ConnectionId:  connectResponse.ConnectionId,
+		Action:        ACTION_SCRAPE,
+		TransactionId: trId,
+	}); err != nil {
+		utils.TFatalf(t, "Failed to pack scrape request: %s", err)
+	}
+	for _, infoHash := range infoHashes {
+		sendBuff.Write(infoHash[:])
+	}
+	send(c, sendBuff.Bytes(), "scrape request", t)
+	n, err := c.Read(recvBuff)
+	if err != nil {
+		utils.TFatalf(t, "Failed to read scrape response: %s", err)
+	}
+	var scrapeResponse ScrapeResponse
+	if err = struc.Unpack(bytes.NewBuffer(recvBuff), &scrapeResponse); err != nil {
+		utils.TFatalf(t, "Failed to unpack scrape response: %s", err)
+	}
+	if scrapeResponse.Action != ACTION_SCRAPE {
+		utils.TErrorf(t, "Invalid scrape response action: received %x, expected %x", scrapeResponse.Action, ACTION_SCRAPE)
+	}
+	if scrapeResponse.TransactionId != trId {
+		utils.TErrorf(t, "Incorrect transaction_id received: %d, expected %d", scrapeResponse.TransactionId, trId)
+	}
+	if n != len(recvBuff) {
+		utils.TErrorf(t, "Unexpected scrape response size: received %d bytes, expected %d", n, len(recvBuff))
+	}
+	for _, infoHash := range infoHashes[:2] {
+		peer, ok := scraped[infoHash]
+		if !ok {
+			utils.TErrorf(t, "Callback for info hash %x not called", infoHash)
+		} else if peer.Request != REQUEST_SCRAPE || !peer.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+			utils.TErrorf(t, "Invalid scrape request: %+v", peer)
+		}
+	}
+}
+
+func TestInvalidConnectionId(t *testing.T) {
+	infoHash := InfoHash(utils.RandomBytes(20))
+	id, _ := tracker.RegisterCallback(infoHash, func(p Peer) {
+		utils.TErrorf(t, "Callback called for an announce with an invalid connection ID from %s", p.IP)
+	})
+	defer tracker.Unregister(infoHash, id)
+	c := connect(addr, t)
+	trId := rand.Uint32()
+	sendBuff := bytes.NewBuffer(make([]byte, 0, ANNONCE_REQUEST_SIZE))
+	if err := struc.Pack(sendBuff, &AnnounceRequest{
+		ConnectionId:  rand.Uint64(),
 		Action:        ACTION_ANNOUNCE,
 		TransactionId: trId,
 		InfoHash:      infoHash,
@@ -125,26 +288,95 @@ func TestTracker(t *testing.T) {
 		utils.TFatalf(t, "Failed to pack announce request: %s", err)
 	}
 	send(c, sendBuff.Bytes(), "announce request", t)
-	// receiving announce response
+	readNothing(c, t)
+}
+
+// readNothing checks that no response is received on c.
+func readNothing(c net.Conn, t *testing.T) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+	recvBuff := make([]byte, 64)
+	if n, err := c.Read(recvBuff); err == nil {
+		utils.TErrorf(t, "Unexpected response received: %x", recvBuff[:n])
+	}
+}
+
+func readError(c net.Conn, trId uint32, expected string, t *testing.T) {
+	recvBuff := make([]byte, 64)
 	n, err := c.Read(recvBuff)
 	if err != nil {
-		utils.TFatalf(t, "Failed to read announce response: %s", err)
+		utils.TFatalf(t, "Failed to read error response: %s", err)
 	}
-	if n != ANNOUNCE_RESPONSE_SIZE {
-		utils.TErrorf(t, "Unexpected announce response size: received %d bytes, expected %d", n, ANNOUNCE_RESPONSE_SIZE)
+	var errorResponse ErrorResponse
+	if err = struc.Unpack(bytes.NewBuffer(recvBuff), &errorResponse); err != nil {
+		utils.TFatalf(t, "Failed to unpack error response: %s", err)
 	}
-	var announceResponse AnnounceResponse
-	if err = struc.Unpack(bytes.NewBuffer(recvBuff), &announceResponse); err != nil {
-		utils.TFatalf(t, "Failed to unpack announce response: %s", err)
+	if errorResponse.Action != ACTION_ERROR || errorResponse.TransactionId != trId {
+		utils.TErrorf(t, "Invalid error response: %+v", errorResponse)
 	}
-	if announceResponse.Action != ACTION_ANNOUNCE {
-		utils.TErrorf(t, "Invalid announce response action: received %x, expected %x", announceResponse.Action, ACTION_ANNOUNCE)
+	if msg := string(recvBuff[ERROR_RESPONSE_SIZE:n]); msg != expected {
+		utils.TErrorf(t, "Invalid error message: got %q, expected %q", msg, expected)
 	}
-	if announceResponse.TransactionId != trId {
-		utils.TErrorf(t, "Incorrect transaction_id received: %d, expected %d", announceResponse.TransactionId, trId)
+}
+
+func TestErrorResponses(t *testing.T) {
+	c := connect(addr, t)
+	connectionId := tracker.connectionId(c.LocalAddr().(*net.UDPAddr), connectionIdEpoch(time.Now()))
+	for _, r := range []struct {
+		action uint32
+		size   int
+		msg    string
+	}{
+		{action: 7, size: 16, msg: "unknown action"},
+		{action: ACTION_ANNOUNCE, size: 50, msg: "invalid packet size"},
+		{action: ACTION_SCRAPE, size: 20, msg: "invalid packet size"},
+	} {
+		packet := make([]byte, r.size)
+		trId := rand.Uint32()
+		binary.BigEndian.PutUint32(packet[8:], r.action)
+		binary.BigEndian.PutUint32(packet[12:], trId)
+		// without a valid connection ID, the request is dropped
+		send(c, packet, "request", t)
+		readNothing(c, t)
+		binary.BigEndian.PutUint64(packet, connectionId)
+		send(c, packet, "request", t)
+		readError(c, trId, r.msg, t)
+	}
+}
+
+func TestParseURLData(t *testing.T) {
+	for _, c := range []struct {
+		options []byte
+		data    string
+		ok      bool
+	}{
+		{options: nil, data: "", ok: true},
+		{options: []byte{OPTION_URL_DATA, 2, '/', 'a', OPTION_END_OF_OPTIONS, OPTION_URL_DATA, 1, 'b'}, data: "/a", ok: true},
+		{options: []byte{OPTION_NOP, 9, 1, 'x', OPTION_URL_DATA, 1, '/'}, data: "/", ok: true}, // unknown option skipped
+		{options: []byte{OPTION_URL_DATA, 3, '/', 'a'}},
+		{options: []byte{OPTION_URL_DATA}},
+	} {
+		data, err := parseURLData(c.options)
+		if data != c.data || (err == nil) != c.ok {
+			utils.TErrorf(t, "Invalid parsing of %v: got %q %v, expected %q", c.options, data, err, c.data)
+		}
 	}
+}
 
-	if !requestIp.Equal(net.IPv4(127, 0, 0, 1)) {
-		utils.TErrorf(t, "Invalid request IP: %s", requestIp)
+func TestConnectionIdWindow(t *testing.T) {
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881}
+	epoch := connectionIdEpoch(time.Now())
+	if !tracker.validConnectionId(src, tracker.connectionId(src, epoch)) {
+		utils.TErrorf(t, "Current connection ID rejected")
+	}
+	if !tracker.validConnectionId(src, tracker.connectionId(src, epoch-1)) {
+		utils.TErrorf(t, "Connection ID of the previous period rejected")
+	}
+	if tracker.validConnectionId(src, tracker.connectionId(src, epoch-2)) {
+		utils.TErrorf(t, "Expired connection ID accepted")
+	}
+	other := &net.UDPAddr{IP: src.IP, Port: 6882}
+	if tracker.validConnectionId(other, tracker.connectionId(src, epoch)) {
+		utils.TErrorf(t, "Connection ID of another address accepted")
 	}
 }
@@ -0,0 +1,337 @@
+package bittorrent
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+const (
+	// path of the WebTorrent tracker on the websocket server
+	WEBTORRENT_PATH = "/webtorrent"
+	// announce interval requested from WebTorrent clients
+	WEBTORRENT_INTERVAL_SECS = 120
+	// WebTorrent connections are closed when no message is received within
+	// this duration
+	WEBTORRENT_IDLE_TIMEOUT = 2 * WEBTORRENT_INTERVAL_SECS * time.Second
+
+	// websocket connections of browser clients (WebTorrent)
+	PROTOCOL_WEBTORRENT = "webtorrent"
+	// ICE candidates of the WebRTC sessions negotiated through the
+	// WebTorrent tracker
+	PROTOCOL_WEBRTC = "webrtc"
+
+	REQUEST_OFFER  = "offer"
+	REQUEST_ANSWER = "answer"
+)
+
+type sessionDescription struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+type webTorrentOffer struct {
+	Offer   sessionDescription `json:"offer"`
+	OfferId string             `json:"offer_id"`
+}
+
+// webTorrentMessage is the union of the messages exchanged with WebTorrent
+// clients. Binary fields, such as info hashes and peer IDs, are sent as
+// strings of code points below 256.
+type webTorrentMessage struct {
+	Action string `json:"action"`
+	// a string in announces, a string or a list of strings in scrapes
+	InfoHash json.RawMessage     `json:"info_hash,omitempty"`
+	PeerId   string              `json:"peer_id,omitempty"`
+	NumWant  int                 `json:"numwant,omitempty"`
+	Event    string              `json:"event,omitempty"`
+	Offers   []webTorrentOffer   `json:"offers,omitempty"`
+	Answer   *sessionDescription `json:"answer,omitempty"`
+	ToPeerId string              `json:"to_peer_id,omitempty"`
+	OfferId  string              `json:"offer_id,omitempty"`
+}
+
+// decodeBinaryString returns the bytes encoded by s, or false if s contains
+// code points above 255.
+func decodeBinaryString(s string) ([]byte, bool) {
+	var b []byte
+	for _, r := range s {
+		if r > 0xff {
+			return nil, false
+		}
+		b = append(b, byte(r))
+	}
+	return b, true
+}
+
+func encodeBinaryString(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// decodeInfoHashes parses the info_hash field of a message, either a single
+// info hash or a list of them.
+func decodeInfoHashes(raw json.RawMessage) ([]InfoHash, bool) {
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, false
+		}
+		list = []string{s}
+	}
+	infoHashes := make([]InfoHash, len(list))
+	for i, s := range list {
+		b, ok := decodeBinaryString(s)
+		if !ok || len(b) != len(InfoHash{}) {
+			return nil, false
+		}
+		infoHashes[i] = InfoHash(b)
+	}
+	return infoHashes, true
+}
+
+// candidatePeers returns the ICE candidates with an IP address found in sdp.
+// Candidates obfuscated with mDNS hostnames are ignored.
+func candidatePeers(sdp string, request string) []Peer {
+	var peers []Peer
+	for _, line := range strings.Split(sdp, "\n") {
+		// a=candidate:<foundation> <component> <transport> <priority> <address> <port> typ <type> ...
+		fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), "a="))
+		if len(fields) < 8 || !strings.HasPrefix(fields[0], "candidate:") || fields[6] != "typ" {
+			continue
+		}
+		ip := net.ParseIP(fields[4])
+		port, err := strconv.Atoi(fields[5])
+		if ip == nil || err != nil {
+			continue
+		}
+		peers = append(peers, Peer{IP: ip, Port: port, Protocol: PROTOCOL_WEBRTC, Request: request, Candidate: fields[7]})
+	}
+	return peers
+}
+
+// joinSwarm adds the connection of peerId to the swarm of k, which is only
+// kept for registered info hashes.
+func (t *Tracker) joinSwarm(k InfoHash, peerId string, ws *websocket.Conn) {
+	if !t.infoHashes.Has(k) {
+		return
+	}
+	t.swarmsMutex.Lock()
+	defer t.swarmsMutex.Unlock()
+	if t.swarms[k] == nil {
+		t.swarms[k] = make(map[string]*websocket.Conn)
+	}
+	t.swarms[k][peerId] = ws
+}
+
+// leaveSwarms removes the connection of peerId from the swarms in which it
+// announced.
+func (t *Tracker) leaveSwarms(infoHashes map[InfoHash]struct{}, peerId string) {
+	t.swarmsMutex.Lock()
+	defer t.swarmsMutex.Unlock()
+	for k := range infoHashes {
+		delete(t.swarms[k], peerId)
+		if len(t.swarms[k]) == 0 {
+			delete(t.swarms, k)
+		}
+	}
+}
+
+// swarmPeers returns at most n connections of the swarm of k, other than
+// the one of peerId.
+func (t *Tracker) swarmPeers(k InfoHash, peerId string, n int) []*websocket.Conn {
+	t.swarmsMutex.Lock()
+	defer t.swarmsMutex.Unlock()
+	var conns []*websocket.Conn
+	for id, ws := range t.swarms[k] {
+		if len(conns) == n {
+			break
+		}
+		if id != peerId {
+			conns = append(conns, ws)
+		}
+	}
+	return conns
+}
+
+func (t *Tracker) swarmSize(k InfoHash) int {
+	t.swarmsMutex.Lock()
+	defer t.swarmsMutex.Unlock()
+	return len(t.swarms[k])
+}
+
+func (t *Tracker) swarmPeer(k InfoHash, peerId string) *websocket.Conn {
+	t.swarmsMutex.Lock()
+	defer t.swarmsMutex.Unlock()
+	return t.swarms[k][peerId]
+}
+
+// SetClientAddr sets the function resolving the address of the WebTorrent
+// clients, such as behind a reverse proxy. It defaults to the remote address
+// of the requests, and must be called before the tracker starts.
+func (t *Tracker) SetClientAddr(f func(r *http.Request) (net.IP, int)) {
+	t.clientAddr = f
+}
+
+// remoteAddr returns the remote address of r, or a nil address if it is
+// invalid.
+func remoteAddr(r *http.Request) (net.IP, int) {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, 0
+	}
+	p, _ := strconv.Atoi(port)
+	return net.ParseIP(host), p
+}
+
+// ServeWebTorrent handles the websocket connections of WebTorrent clients.
+// It reports the clients announcing registered info hashes, as well as the
+// ICE candidates of the offers and answers they exchange through the
+// tracker, which can reveal their local and public addresses.
+func (t *Tracker) ServeWebTorrent(w http.ResponseWriter, r *http.Request) {
+	ip, port := t.clientAddr(r)
+	if ip == nil {
+		log.Printf("%s Error: invalid remote address: %s", TRACKER_LOG_TAG, r.RemoteAddr)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// torrents can be opened from any page
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		log.Printf("%s Error: failed to accept WebTorrent connection: %s", TRACKER_LOG_TAG, err)
+		return
+	}
+	defer ws.CloseNow()
+	client := Peer{IP: ip, Port: port, Protocol: PROTOCOL_WEBTORRENT}
+	var peerId string
+	joined := make(map[InfoHash]struct{})
+	defer func() { t.leaveSwarms(joined, peerId) }()
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), WEBTORRENT_IDLE_TIMEOUT)
+		var msg webTorrentMessage
+		err := wsjson.Read(ctx, ws, &msg)
+		cancel()
+		if err != nil {
+			return
+		}
+		switch msg.Action {
+		case REQUEST_ANNOUNCE:
+			infoHashes, ok := decodeInfoHashes(msg.InfoHash)
+			if !ok || len(infoHashes) != 1 {
+				webTorrentFailure(ws, msg.Action, "invalid info_hash")
+				continue
+			}
+			if peerId != "" && msg.PeerId != peerId {
+				webTorrentFailure(ws, msg.Action, "invalid peer_id")
+				continue
+			}
+			peerId = msg.PeerId
+			t.handleWebTorrentAnnounce(ws, client, infoHashes[0], &msg, joined)
+		case REQUEST_SCRAPE:
+			t.handleWebTorrentScrape(ws, client, msg.InfoHash)
+		default:
+			webTorrentFailure(ws, msg.Action, "unknown action")
+		}
+	}
+}
+
+// writeWebTorrent sends msg to ws, giving up after PEER_WIRE_TIMEOUT so that
+// a stalled client can't block the others.
+func writeWebTorrent(ws *websocket.Conn, msg any) {
+	ctx, cancel := context.WithTimeout(context.Background(), PEER_WIRE_TIMEOUT)
+	defer cancel()
+	wsjson.Write(ctx, ws, msg)
+}
+
+func webTorrentFailure(ws *websocket.Conn, action string, reason string) {
+	writeWebTorrent(ws, map[string]any{"action": action, "failure reason": reason})
+}
+
+func (t *Tracker) handleWebTorrentAnnounce(ws *websocket.Conn, client Peer, k InfoHash, msg *webTorrentMessage, joined map[InfoHash]struct{}) {
+	peerId, _ := decodeBinaryString(msg.PeerId)
+	infoHash := encodeBinaryString(k[:])
+	if msg.Answer != nil {
+		// answers are relayed without a response to the answering client
+		for _, p := range candidatePeers(msg.Answer.SDP, REQUEST_ANSWER) {
+			p.PeerID = string(peerId)
+			t.Notify(k, p)
+		}
+		if to := t.swarmPeer(k, msg.ToPeerId); to != nil {
+			writeWebTorrent(to, map[string]any{
+				"action":    REQUEST_ANNOUNCE,
+				"answer":    msg.Answer,
+				"offer_id":  msg.OfferId,
+				"peer_id":   msg.PeerId,
+				"info_hash": infoHash,
+			})
+		}
+		return
+	}
+	client.Request = REQUEST_ANNOUNCE
+	client.PeerID = string(peerId)
+	client.Event = msg.Event
+	t.Notify(k, client)
+	for _, offer := range msg.Offers {
+		for _, p := range candidatePeers(offer.Offer.SDP, REQUEST_OFFER) {
+			p.PeerID = string(peerId)
+			t.Notify(k, p)
+		}
+	}
+	if msg.Event == "stopped" {
+		t.leaveSwarms(map[InfoHash]struct{}{k: {}}, msg.PeerId)
+		delete(joined, k)
+	} else {
+		t.joinSwarm(k, msg.PeerId, ws)
+		joined[k] = struct{}{}
+	}
+	writeWebTorrent(ws, map[string]any{
+		"action":     REQUEST_ANNOUNCE,
+		"interval":   WEBTORRENT_INTERVAL_SECS,
+		"info_hash":  infoHash,
+		"complete":   0,
+		"incomplete": t.swarmSize(k),
+	})
+	// each offer is sent to a different peer, which answers through the
+	// tracker
+	n := len(msg.Offers)
+	if msg.NumWant > 0 {
+		n = min(n, msg.NumWant)
+	}
+	conns := t.swarmPeers(k, msg.PeerId, n)
+	for i, to := range conns {
+		writeWebTorrent(to, map[string]any{
+			"action":    REQUEST_ANNOUNCE,
+			"offer":     msg.Offers[i].Offer,
+			"offer_id":  msg.Offers[i].OfferId,
+			"peer_id":   msg.PeerId,
+			"info_hash": infoHash,
+		})
+	}
+}
+
+func (t *Tracker) handleWebTorrentScrape(ws *websocket.Conn, client Peer, raw json.RawMessage) {
+	infoHashes, ok := decodeInfoHashes(raw)
+	if !ok {
+		webTorrentFailure(ws, REQUEST_SCRAPE, "invalid info_hash")
+		return
+	}
+	client.Request = REQUEST_SCRAPE
+	files := make(map[string]any, len(infoHashes))
+	for _, k := range infoHashes {
+		t.Notify(k, client)
+		files[encodeBinaryString(k[:])] = map[string]int{"complete": 0, "incomplete": 0, "downloaded": 0}
+	}
+	writeWebTorrent(ws, map[string]any{"action": REQUEST_SCRAPE, "files": files})
+}
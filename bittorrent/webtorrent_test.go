@@ -0,0 +1,126 @@
+package bittorrent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"zeroleaks/utils"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+const offerSDP = "v=0\r\n" +
+	"o=- 4611731400430051336 2 IN IP4 127.0.0.1\r\n" +
+	"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=candidate:1 1 udp 2122260223 192.168.1.10 50000 typ host generation 0\r\n" +
+	"a=candidate:2 1 udp 2122260223 0a1b2c3d-0000-4000-8000-000000000000.local 50001 typ host\r\n" +
+	"a=candidate:3 1 udp 1686052607 203.0.113.7 50002 typ srflx raddr 192.168.1.10 rport 50000\r\n"
+
+const answerSDP = "v=0\r\n" +
+	"a=candidate:1 1 udp 2122260223 2001:db8::7 40000 typ host\r\n"
+
+func webTorrentConnect(url string, t *testing.T) *websocket.Conn {
+	ws, _, err := websocket.Dial(context.Background(), url, nil)
+	if err != nil {
+		utils.TFatalf(t, "Failed to connect to the WebTorrent tracker: %s", err)
+	}
+	return ws
+}
+
+func webTorrentSend(ws *websocket.Conn, msg any, t *testing.T) {
+	if err := wsjson.Write(context.Background(), ws, msg); err != nil {
+		utils.TFatalf(t, "Failed to send WebTorrent message: %s", err)
+	}
+}
+
+func webTorrentRead(ws *websocket.Conn, t *testing.T) map[string]any {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var msg map[string]any
+	if err := wsjson.Read(ctx, ws, &msg); err != nil {
+		utils.TFatalf(t, "Failed to read WebTorrent message: %s", err)
+	}
+	return msg
+}
+
+func TestWebTorrent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(tracker.ServeWebTorrent))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	infoHash := InfoHash(utils.RandomBytes(20))
+	peers := make(chan Peer, 16)
+	id, _ := tracker.RegisterCallback(infoHash, func(p Peer) {
+		peers <- p
+	})
+	defer tracker.Unregister(infoHash, id)
+	encodedInfoHash := encodeBinaryString(infoHash[:])
+	seeder, leecher := webTorrentConnect(url, t), webTorrentConnect(url, t)
+	defer seeder.CloseNow()
+	defer leecher.CloseNow()
+
+	webTorrentSend(seeder, map[string]any{"action": "announce", "info_hash": encodedInfoHash, "peer_id": "-WW0208-seederseeder", "event": "started"}, t)
+	if res := webTorrentRead(seeder, t); res["action"] != "announce" || res["info_hash"] != encodedInfoHash || res["incomplete"] != float64(1) {
+		utils.TErrorf(t, "Invalid announce response: %v", res)
+	}
+	webTorrentSend(leecher, map[string]any{
+		"action":    "announce",
+		"info_hash": encodedInfoHash,
+		"peer_id":   "-WW0208-leecherleech",
+		"numwant":   1,
+		"offers":    []map[string]any{{"offer": map[string]string{"type": "offer", "sdp": offerSDP}, "offer_id": "offer-1"}},
+	}, t)
+	if res := webTorrentRead(leecher, t); res["incomplete"] != float64(2) {
+		utils.TErrorf(t, "Invalid announce response: %v", res)
+	}
+	offer := webTorrentRead(seeder, t)
+	if offer["offer_id"] != "offer-1" || offer["peer_id"] != "-WW0208-leecherleech" || offer["info_hash"] != encodedInfoHash {
+		utils.TErrorf(t, "Invalid relayed offer: %v", offer)
+	}
+	webTorrentSend(seeder, map[string]any{
+		"action":     "announce",
+		"info_hash":  encodedInfoHash,
+		"peer_id":    "-WW0208-seederseeder",
+		"to_peer_id": "-WW0208-leecherleech",
+		"offer_id":   "offer-1",
+		"answer":     map[string]string{"type": "answer", "sdp": answerSDP},
+	}, t)
+	if answer := webTorrentRead(leecher, t); answer["offer_id"] != "offer-1" || answer["peer_id"] != "-WW0208-seederseeder" {
+		utils.TErrorf(t, "Invalid relayed answer: %v", answer)
+	}
+
+	for _, expected := range []Peer{
+		{IP: net.IPv4(127, 0, 0, 1), Protocol: PROTOCOL_WEBTORRENT, Request: REQUEST_ANNOUNCE, PeerID: "-WW0208-seederseeder"},
+		{IP: net.IPv4(127, 0, 0, 1), Protocol: PROTOCOL_WEBTORRENT, Request: REQUEST_ANNOUNCE, PeerID: "-WW0208-leecherleech"},
+		{IP: net.IPv4(192, 168, 1, 10), Port: 50000, Protocol: PROTOCOL_WEBRTC, Request: REQUEST_OFFER, Candidate: "host"},
+		{IP: net.IPv4(203, 0, 113, 7), Port: 50002, Protocol: PROTOCOL_WEBRTC, Request: REQUEST_OFFER, Candidate: "srflx"},
+		{IP: net.ParseIP("2001:db8::7"), Port: 40000, Protocol: PROTOCOL_WEBRTC, Request: REQUEST_ANSWER, Candidate: "host"},
+	} {
+		p := <-peers
+		if !p.IP.Equal(expected.IP) || p.Protocol != expected.Protocol || p.Request != expected.Request || p.Candidate != expected.Candidate || (expected.Port != 0 && p.Port != expected.Port) {
+			utils.TErrorf(t, "Invalid peer: got %+v, expected %+v", p, expected)
+		}
+		if expected.PeerID != "" && p.PeerID != expected.PeerID {
+			utils.TErrorf(t, "Invalid peer ID: %q", p.PeerID)
+		}
+	}
+	select {
+	case p := <-peers:
+		utils.TErrorf(t, "Unexpected peer: %+v", p)
+	default:
+	}
+
+	webTorrentSend(seeder, map[string]any{"action": "scrape", "info_hash": []string{encodedInfoHash}}, t)
+	if res := webTorrentRead(seeder, t); res["action"] != "scrape" || res["files"].(map[string]any)[encodedInfoHash] == nil {
+		utils.TErrorf(t, "Invalid scrape response: %v", res)
+	}
+	webTorrentSend(seeder, map[string]any{"action": "announce", "info_hash": "short"}, t)
+	if res := webTorrentRead(seeder, t); res["failure reason"] != "invalid info_hash" {
+		utils.TErrorf(t, "Invalid failure response: %v", res)
+	}
+}
@@ -0,0 +1,204 @@
+package bittorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+	"zeroleaks/bencode"
+	"zeroleaks/utils"
+)
+
+const (
+	PROTOCOL_NAME  = "BitTorrent protocol"
+	HANDSHAKE_SIZE = 49 + len(PROTOCOL_NAME)
+	CLIENT_NAME    = "ZeroLeaks"
+
+	// maximum duration of a peer-wire connection
+	PEER_WIRE_TIMEOUT = 10 * time.Second
+	// messages of larger size are not read
+	MAX_MESSAGE_SIZE = 1 << 16
+
+	MESSAGE_PORT       = 9
+	MESSAGE_EXTENDED   = 20
+	EXTENDED_HANDSHAKE = 0
+
+	// reserved bit of the extension protocol (BEP 10)
+	RESERVED_EXTENSION = 43
+	// reserved bit of the DHT (BEP 5)
+	RESERVED_DHT = 63
+)
+
+// peerId identifies the helper in peer-wire handshakes and tracker responses.
+var peerId = "-ZL0100-" + string(utils.RandomBytes(12))
+
+var errInvalidMessage = errors.New("invalid message")
+
+// supports tells whether bit is set in reserved, counting from the most
+// significant bit of the first byte.
+func supports(reserved [8]byte, bit int) bool {
+	return reserved[bit/8]&(0x80>>(bit%8)) != 0
+}
+
+type handshake struct {
+	Reserved [8]byte
+	InfoHash InfoHash
+	PeerId   [20]byte
+}
+
+func readHandshake(c net.Conn) (*handshake, error) {
+	buff := make([]byte, HANDSHAKE_SIZE)
+	if _, err := io.ReadFull(c, buff); err != nil {
+		return nil, err
+	}
+	if int(buff[0]) != len(PROTOCOL_NAME) || string(buff[1:1+len(PROTOCOL_NAME)]) != PROTOCOL_NAME {
+		return nil, errInvalidMessage
+	}
+	var h handshake
+	offset := 1 + len(PROTOCOL_NAME)
+	copy(h.Reserved[:], buff[offset:])
+	copy(h.InfoHash[:], buff[offset+8:])
+	copy(h.PeerId[:], buff[offset+28:])
+	return &h, nil
+}
+
+func (h *handshake) bytes() []byte {
+	buff := append([]byte{byte(len(PROTOCOL_NAME))}, PROTOCOL_NAME...)
+	buff = append(buff, h.Reserved[:]...)
+	buff = append(buff, h.InfoHash[:]...)
+	return append(buff, h.PeerId[:]...)
+}
+
+// readMessage returns the ID and the payload of the next message. Keep-alive
+// messages are skipped.
+func readMessage(c net.Conn) (byte, []byte, error) {
+	for {
+		var size uint32
+		if err := binary.Read(c, binary.BigEndian, &size); err != nil {
+			return 0, nil, err
+		}
+		if size == 0 {
+			continue
+		}
+		if size > MAX_MESSAGE_SIZE {
+			return 0, nil, errInvalidMessage
+		}
+		buff := make([]byte, size)
+		if _, err := io.ReadFull(c, buff); err != nil {
+			return 0, nil, err
+		}
+		return buff[0], buff[1:], nil
+	}
+}
+
+func message(id byte, payload []byte) []byte {
+	buff := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)))
+	buff = append(buff, id)
+	return append(buff, payload...)
+}
+
+// extensionHandshake returns the extension handshake (BEP 10) sent to a
+// client with address ip.
+func (t *Tracker) extensionHandshake(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	payload, _ := bencode.Marshal(map[string]any{
+		"m":      map[string]any{},
+		"v":      CLIENT_NAME,
+		"yourip": []byte(ip),
+		"p":      t.peerPort,
+	})
+	return message(MESSAGE_EXTENDED, append([]byte{EXTENDED_HANDSHAKE}, payload...))
+}
+
+// parseExtensionHandshake sets the fields of p advertised in the extension
+// handshake payload.
+func parseExtensionHandshake(p *Peer, payload []byte) {
+	v, err := bencode.Unmarshal(payload)
+	if err != nil {
+		return
+	}
+	dict, _ := v.(map[string]any)
+	p.Client, _ = dict["v"].(string)
+	if yourip, _ := dict["yourip"].(string); len(yourip) == net.IPv4len || len(yourip) == net.IPv6len {
+		p.YourIP = net.IP(yourip)
+	}
+	if port, _ := dict["p"].(int64); port > 0 && port <= 0xffff {
+		p.ListenPort = int(port)
+	}
+}
+
+func (t *Tracker) handlePeerWire(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(PEER_WIRE_TIMEOUT))
+	h, err := readHandshake(c)
+	if err != nil {
+		log.Printf("%s Error: invalid handshake received from %s: %s", TRACKER_LOG_TAG, c.RemoteAddr(), err)
+		return
+	}
+	if !t.infoHashes.Has(h.InfoHash) {
+		return
+	}
+	addr := c.RemoteAddr().(*net.TCPAddr)
+	peer := Peer{
+		IP:       addr.IP,
+		Port:     addr.Port,
+		Protocol: PROTOCOL_PEER_WIRE,
+		Request:  REQUEST_HANDSHAKE,
+		PeerID:   string(h.PeerId[:]),
+		Reserved: h.Reserved,
+	}
+	// the client is reported once it sent everything it is expected to
+	defer func() { t.Notify(h.InfoHash, peer) }()
+
+	response := handshake{InfoHash: h.InfoHash}
+	copy(response.PeerId[:], peerId)
+	response.Reserved[RESERVED_EXTENSION/8] |= 0x80 >> (RESERVED_EXTENSION % 8)
+	if t.dhtPort != 0 {
+		response.Reserved[RESERVED_DHT/8] |= 0x80 >> (RESERVED_DHT % 8)
+	}
+	buff := bytes.NewBuffer(response.bytes())
+	if supports(h.Reserved, RESERVED_EXTENSION) {
+		buff.Write(t.extensionHandshake(addr.IP))
+	}
+	if t.dhtPort != 0 && supports(h.Reserved, RESERVED_DHT) {
+		buff.Write(message(MESSAGE_PORT, binary.BigEndian.AppendUint16(nil, uint16(t.dhtPort))))
+	}
+	if _, err := c.Write(buff.Bytes()); err != nil {
+		return
+	}
+	if !supports(h.Reserved, RESERVED_EXTENSION) {
+		return
+	}
+	for {
+		id, payload, err := readMessage(c)
+		if err != nil {
+			return
+		}
+		if id == MESSAGE_EXTENDED && len(payload) > 0 && payload[0] == EXTENDED_HANDSHAKE {
+			parseExtensionHandshake(&peer, payload[1:])
+			return
+		}
+	}
+}
+
+// ServePeerWire accepts peer-wire connections (BEP 3) on l. Clients
+// connecting about registered info hashes are reported after the handshake,
+// along with the details of their extension handshake.
+func (t *Tracker) ServePeerWire(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("%s Error while accepting peer-wire connection: %s", TRACKER_LOG_TAG, err)
+			continue
+		}
+		go t.handlePeerWire(c)
+	}
+}
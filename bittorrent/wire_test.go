@@ -0,0 +1,95 @@
+package bittorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+	"zeroleaks/bencode"
+	"zeroleaks/utils"
+)
+
+func TestPeerWire(t *testing.T) {
+	infoHash := InfoHash(utils.RandomBytes(20))
+	reported := make(chan Peer, 1)
+	id, _ := tracker.RegisterCallback(infoHash, func(p Peer) {
+		reported <- p
+	})
+	defer tracker.Unregister(infoHash, id)
+
+	c, err := net.DialTCP("tcp", nil, peerWireAddr)
+	if err != nil {
+		utils.TFatalf(t, "Cannot connect to the peer-wire server: %s", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	h := handshake{InfoHash: infoHash}
+	copy(h.PeerId[:], "-qB4650-abcdefghijkl")
+	h.Reserved[5] = 0x10 // extension protocol
+	h.Reserved[7] = 0x01 // DHT
+	if _, err := c.Write(h.bytes()); err != nil {
+		utils.TFatalf(t, "Failed to send handshake: %s", err)
+	}
+	response, err := readHandshake(c)
+	if err != nil {
+		utils.TFatalf(t, "Failed to read handshake: %s", err)
+	}
+	if response.InfoHash != infoHash || string(response.PeerId[:]) != peerId {
+		utils.TErrorf(t, "Invalid handshake received: %+v", response)
+	}
+	if !supports(response.Reserved, RESERVED_EXTENSION) || !supports(response.Reserved, RESERVED_DHT) {
+		utils.TErrorf(t, "Extension protocol and DHT not advertised: %x", response.Reserved)
+	}
+	msgId, payload, err := readMessage(c)
+	if err != nil || msgId != MESSAGE_EXTENDED || len(payload) == 0 || payload[0] != EXTENDED_HANDSHAKE {
+		utils.TFatalf(t, "Invalid extension handshake received: %d %q %v", msgId, payload, err)
+	}
+	v, err := bencode.Unmarshal(payload[1:])
+	if dict, _ := v.(map[string]any); err != nil || dict["v"] != CLIENT_NAME || dict["yourip"] != string(net.IPv4(127, 0, 0, 1).To4()) {
+		utils.TErrorf(t, "Invalid extension handshake: %#v %v", v, err)
+	}
+	msgId, payload, err = readMessage(c)
+	if err != nil || msgId != MESSAGE_PORT || binary.BigEndian.Uint16(payload) != 6881 {
+		utils.TErrorf(t, "Invalid PORT message received: %d %x %v", msgId, payload, err)
+	}
+
+	ext, _ := bencode.Marshal(map[string]any{"m": map[string]any{}, "v": "qBittorrent/4.6.5", "yourip": "\xc0\x00\x02\x01", "p": 51413})
+	var buff bytes.Buffer
+	buff.Write([]byte{0, 0, 0, 0}) // keep-alive
+	buff.Write(message(2, nil))    // interested
+	buff.Write(message(MESSAGE_EXTENDED, append([]byte{EXTENDED_HANDSHAKE}, ext...)))
+	if _, err := c.Write(buff.Bytes()); err != nil {
+		utils.TFatalf(t, "Failed to send extension handshake: %s", err)
+	}
+	select {
+	case p := <-reported:
+		if p.Protocol != PROTOCOL_PEER_WIRE || p.Request != REQUEST_HANDSHAKE || !p.IP.Equal(net.IPv4(127, 0, 0, 1)) || p.Port != c.LocalAddr().(*net.TCPAddr).Port {
+			utils.TErrorf(t, "Invalid peer-wire connection reported: %+v", p)
+		}
+		if p.PeerID != string(h.PeerId[:]) || p.Reserved != h.Reserved {
+			utils.TErrorf(t, "Invalid handshake reported: %q %x", p.PeerID, p.Reserved)
+		}
+		if p.Client != "qBittorrent/4.6.5" || !p.YourIP.Equal(net.IPv4(192, 0, 2, 1)) || p.ListenPort != 51413 {
+			utils.TErrorf(t, "Invalid extension handshake reported: %q %s %d", p.Client, p.YourIP, p.ListenPort)
+		}
+	case <-time.After(time.Second):
+		utils.TFatalf(t, "Peer-wire connection not reported")
+	}
+}
+
+func TestPeerWireUnknownInfoHash(t *testing.T) {
+	c, err := net.DialTCP("tcp", nil, peerWireAddr)
+	if err != nil {
+		utils.TFatalf(t, "Cannot connect to the peer-wire server: %s", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	h := handshake{InfoHash: InfoHash(utils.RandomBytes(20))}
+	if _, err := c.Write(h.bytes()); err != nil {
+		utils.TFatalf(t, "Failed to send handshake: %s", err)
+	}
+	if _, err := readHandshake(c); err == nil {
+		utils.TErrorf(t, "Handshake answered for an unknown info hash")
+	}
+}
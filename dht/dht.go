@@ -0,0 +1,134 @@
+// Package dht implements a minimal Mainline DHT node (BEP 5). It doesn't take
+// part in the DHT, but answers the queries of the clients which contact it
+// and reports the ones looking for registered info hashes.
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"log"
+	"net"
+	"zeroleaks/bencode"
+	"zeroleaks/bittorrent"
+	"zeroleaks/utils"
+)
+
+const (
+	DHT_LOG_TAG = "DHT node:"
+
+	MAX_PACKET_SIZE = 2048
+	NODE_ID_SIZE    = 20
+	TOKEN_SIZE      = 8
+
+	ERROR_PROTOCOL       = 203
+	ERROR_METHOD_UNKNOWN = 204
+)
+
+type Node struct {
+	conn net.PacketConn
+	id   string
+	// secret authenticates the tokens handed out in get_peers responses.
+	secret []byte
+	notify func(bittorrent.InfoHash, bittorrent.Peer)
+}
+
+// NewNode listens on addr. notify is called for every get_peers and
+// announce_peer query received.
+func NewNode(addr string, notify func(bittorrent.InfoHash, bittorrent.Peer)) (*Node, int, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, -1, err
+	}
+	node := Node{
+		conn:   conn,
+		id:     string(utils.RandomBytes(NODE_ID_SIZE)),
+		secret: utils.RandomBytes(32),
+		notify: notify,
+	}
+	return &node, conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// token returns the token a client with address ip must send back in its
+// announce_peer queries.
+func (n *Node) token(ip net.IP) string {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write(ip)
+	return string(mac.Sum(nil)[:TOKEN_SIZE])
+}
+
+func (n *Node) send(dst net.Addr, msg map[string]any) {
+	packet, err := bencode.Marshal(msg)
+	if err != nil {
+		log.Printf("%s Error: failed to encode message to %s: %s", DHT_LOG_TAG, dst, err)
+		return
+	}
+	if _, err := n.conn.WriteTo(packet, dst); err != nil {
+		log.Printf("%s Error while sending UDP packet to %s: %s", DHT_LOG_TAG, dst, err)
+	}
+}
+
+func (n *Node) sendError(dst net.Addr, transactionId string, code int, msg string) {
+	n.send(dst, map[string]any{"t": transactionId, "y": "e", "e": []any{code, msg}})
+}
+
+func (n *Node) handle(src *net.UDPAddr, packet []byte) {
+	v, err := bencode.Unmarshal(packet)
+	if err != nil {
+		log.Printf("%s Error: invalid message received from %s: %s", DHT_LOG_TAG, src, err)
+		return
+	}
+	msg, ok := v.(map[string]any)
+	if !ok {
+		log.Printf("%s Error: invalid message received from %s", DHT_LOG_TAG, src)
+		return
+	}
+	transactionId, _ := msg["t"].(string)
+	if y, _ := msg["y"].(string); y != "q" {
+		// the node never sends queries, so it doesn't expect any response
+		return
+	}
+	method, _ := msg["q"].(string)
+	args, _ := msg["a"].(map[string]any)
+	if id, _ := args["id"].(string); len(id) != NODE_ID_SIZE {
+		n.sendError(src, transactionId, ERROR_PROTOCOL, "invalid id")
+		return
+	}
+	response := map[string]any{"id": n.id}
+	switch method {
+	case "ping":
+	case "find_node":
+		response["nodes"] = ""
+	case bittorrent.REQUEST_GET_PEERS, bittorrent.REQUEST_ANNOUNCE_PEER:
+		infoHash, _ := args["info_hash"].(string)
+		if len(infoHash) != len(bittorrent.InfoHash{}) {
+			n.sendError(src, transactionId, ERROR_PROTOCOL, "invalid info_hash")
+			return
+		}
+		peer := bittorrent.Peer{IP: src.IP, Port: src.Port, Protocol: bittorrent.PROTOCOL_DHT, Request: method}
+		// the client is reported even if its token is invalid: its IP leaked
+		n.notify(bittorrent.InfoHash([]byte(infoHash)), peer)
+		if method == bittorrent.REQUEST_GET_PEERS {
+			response["token"] = n.token(src.IP)
+			response["nodes"] = ""
+		} else if token, _ := args["token"].(string); !hmac.Equal([]byte(token), []byte(n.token(src.IP))) {
+			n.sendError(src, transactionId, ERROR_PROTOCOL, "bad token")
+			return
+		}
+	default:
+		n.sendError(src, transactionId, ERROR_METHOD_UNKNOWN, "method unknown")
+		return
+	}
+	n.send(src, map[string]any{"t": transactionId, "y": "r", "r": response})
+}
+
+func (n *Node) Start() {
+	buff := make([]byte, MAX_PACKET_SIZE)
+	for {
+		size, src, err := n.conn.ReadFrom(buff)
+		if err != nil {
+			log.Printf("%s Error while reading UDP packet from %s: %s", DHT_LOG_TAG, src, err)
+			continue
+		}
+		n.handle(src.(*net.UDPAddr), buff[:size])
+	}
+}
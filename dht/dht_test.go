@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"zeroleaks/bencode"
+	"zeroleaks/bittorrent"
+	"zeroleaks/utils"
+)
+
+var node *Node
+var mutex sync.Mutex
+var peers = make(map[bittorrent.InfoHash][]bittorrent.Peer)
+
+func TestMain(m *testing.M) {
+	n, _, err := NewNode("127.0.0.1:0", func(infoHash bittorrent.InfoHash, p bittorrent.Peer) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		peers[infoHash] = append(peers[infoHash], p)
+	})
+	if err != nil {
+		panic(err)
+	}
+	node = n
+	go node.Start()
+	os.Exit(m.Run())
+}
+
+func peersOf(infoHash bittorrent.InfoHash) []bittorrent.Peer {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return peers[infoHash]
+}
+
+// query sends a KRPC query to the node and returns its response.
+func query(c net.Conn, method string, args map[string]any, t *testing.T) map[string]any {
+	args["id"] = string(utils.RandomBytes(NODE_ID_SIZE))
+	packet, err := bencode.Marshal(map[string]any{"t": "aa", "y": "q", "q": method, "a": args})
+	if err != nil {
+		utils.TFatalf(t, "Failed to encode query: %s", err)
+	}
+	return exchange(c, packet, t)
+}
+
+func exchange(c net.Conn, packet []byte, t *testing.T) map[string]any {
+	if _, err := c.Write(packet); err != nil {
+		utils.TFatalf(t, "Failed to send query: %s", err)
+	}
+	buff := make([]byte, MAX_PACKET_SIZE)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := c.Read(buff)
+	if err != nil {
+		utils.TFatalf(t, "Failed to read response: %s", err)
+	}
+	v, err := bencode.Unmarshal(buff[:n])
+	if err != nil {
+		utils.TFatalf(t, "Failed to decode response: %s", err)
+	}
+	msg, ok := v.(map[string]any)
+	if !ok || msg["t"] != "aa" {
+		utils.TFatalf(t, "Invalid response: %#v", v)
+	}
+	return msg
+}
+
+func assertError(msg map[string]any, code int64, t *testing.T) {
+	e, _ := msg["e"].([]any)
+	if msg["y"] != "e" || len(e) != 2 || e[0] != code {
+		utils.TErrorf(t, "Invalid error response: got %#v, expected code %d", msg, code)
+	}
+}
+
+func assertResponse(msg map[string]any, t *testing.T) map[string]any {
+	r, ok := msg["r"].(map[string]any)
+	if msg["y"] != "r" || !ok || r["id"] != node.id {
+		utils.TFatalf(t, "Invalid response: %#v", msg)
+	}
+	return r
+}
+
+func TestNode(t *testing.T) {
+	c, err := net.Dial("udp", node.conn.LocalAddr().String())
+	if err != nil {
+		utils.TFatalf(t, "Cannot connect to the DHT node: %s", err)
+	}
+	defer c.Close()
+	assertResponse(query(c, "ping", map[string]any{}, t), t)
+	r := assertResponse(query(c, "find_node", map[string]any{"target": string(utils.RandomBytes(NODE_ID_SIZE))}, t), t)
+	if _, ok := r["nodes"]; !ok {
+		utils.TErrorf(t, "No nodes in find_node response: %#v", r)
+	}
+
+	infoHash := bittorrent.InfoHash(utils.RandomBytes(20))
+	r = assertResponse(query(c, "get_peers", map[string]any{"info_hash": string(infoHash[:])}, t), t)
+	token, _ := r["token"].(string)
+	if len(token) != TOKEN_SIZE {
+		utils.TErrorf(t, "Invalid token in get_peers response: %#v", r)
+	}
+	assertResponse(query(c, "announce_peer", map[string]any{
+		"info_hash": string(infoHash[:]),
+		"port":      6881,
+		"token":     token,
+	}, t), t)
+	assertError(query(c, "announce_peer", map[string]any{
+		"info_hash": string(infoHash[:]),
+		"port":      6881,
+		"token":     "invalid",
+	}, t), ERROR_PROTOCOL, t)
+	p := peersOf(infoHash)
+	if len(p) != 3 {
+		utils.TFatalf(t, "Invalid number of requests reported: got %d, expected 3", len(p))
+	}
+	for i, request := range []string{bittorrent.REQUEST_GET_PEERS, bittorrent.REQUEST_ANNOUNCE_PEER, bittorrent.REQUEST_ANNOUNCE_PEER} {
+		if p[i].Request != request || p[i].Protocol != bittorrent.PROTOCOL_DHT || !p[i].IP.Equal(net.IPv4(127, 0, 0, 1)) || p[i].Port != c.LocalAddr().(*net.UDPAddr).Port {
+			utils.TErrorf(t, "Invalid request reported: %+v", p[i])
+		}
+	}
+
+	assertError(query(c, "get_peers", map[string]any{"info_hash": "short"}, t), ERROR_PROTOCOL, t)
+	assertError(query(c, "unknown", map[string]any{}, t), ERROR_METHOD_UNKNOWN, t)
+	assertError(exchange(c, []byte("d1:t2:aa1:y1:q1:q4:pinge"), t), ERROR_PROTOCOL, t) // missing id
+}
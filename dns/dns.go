@@ -3,58 +3,253 @@ package dns
 import (
 	"log"
 	"net"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"zeroleaks/registry"
 
-	"github.com/jellydator/ttlcache/v3"
 	"github.com/miekg/dns"
 )
 
+const (
+	TRANSPORT_UDP = "udp"
+	TRANSPORT_TCP = "tcp"
+)
+
+// ClientSubnet is the EDNS Client Subnet option (RFC 7871) forwarded by a
+// recursive resolver. It reveals the network of the end user on whose
+// behalf the resolver is querying.
+type ClientSubnet struct {
+	Family  uint16
+	Prefix  uint8
+	Address net.IP
+}
+
+// Query describes a DNS request received for a registered subdomain.
+type Query struct {
+	IP           net.IP
+	Port         int
+	Transport    string
+	ClientSubnet *ClientSubnet
+	// Name is the queried name, with its original case.
+	Name string
+	// Subdomain is the lowercase part of Name preceding the top domain. It
+	// ends with the registered Token, preceded by the extra Labels.
+	Subdomain string
+	Token     string
+	Labels    []string
+	Type      uint16
+	ID        uint16
+	// EDNS fields, only set if the query contains an OPT record.
+	EDNS     bool
+	UDPSize  uint16
+	DNSSECOk bool
+	Cookie   bool
+}
+
+const (
+	// subdomain doesn't exist, NXDOMAIN is returned
+	PROBE_NONE = iota
+	// subdomain resolves to the server addresses, with a valid signature
+	PROBE_SIGNED
+	// subdomain resolves to the server addresses, with a corrupted signature
+	PROBE_BOGUS
+	// subdomain is an empty non-terminal: it exists but only its children
+	// have records, which resolvers minimising query names need to see
+	PROBE_ENT
+)
+
 type DnsServer struct {
 	topDomain  string
-	subdomains *ttlcache.Cache[uint32, func(net.IP)]
+	subdomains *registry.Registry[string, Query, int]
+	// signer and zone can be replaced while the server is running.
+	signer atomic.Pointer[Signer]
+	zone   atomic.Pointer[Zone]
 }
 
 func NewServer(topDomain string, timeout time.Duration) *DnsServer {
-	server := DnsServer{
-		topDomain: topDomain,
-		subdomains: ttlcache.New(
-			ttlcache.WithTTL[uint32, func(net.IP)](timeout),
-			ttlcache.WithDisableTouchOnHit[uint32, func(net.IP)](),
-		),
+	s := &DnsServer{
+		topDomain:  topDomain,
+		subdomains: registry.New[string, Query, int](timeout),
 	}
-	go server.subdomains.Start()
-	return &server
+	s.SetZone(Zone{Answer: ANSWER_NXDOMAIN, TTL: DEFAULT_TTL})
+	return s
+}
+
+// EnableDNSSEC signs the DNSKEY record of the zone and the records of
+// DNSSEC probe subdomains with signer.
+func (s *DnsServer) EnableDNSSEC(signer *Signer) {
+	s.signer.Store(signer)
+}
+
+func (s *DnsServer) SetZone(zone Zone) {
+	s.zone.Store(&zone)
+}
+
+// RegisterCallback adds f to the observers of the subdomain k. inUse is true
+// if k was already registered.
+func (s *DnsServer) RegisterCallback(k string, f func(Query)) (id uint64, inUse bool) {
+	return s.subdomains.Register(k, PROBE_NONE, f)
+}
+
+// RegisterDNSSECProbe registers a subdomain resolving to the server
+// addresses. If bogus is true, the records are served with an invalid
+// signature, so validating resolvers must refuse to resolve it.
+func (s *DnsServer) RegisterDNSSECProbe(k string, bogus bool, f func(Query)) (id uint64, inUse bool) {
+	probe := PROBE_SIGNED
+	if bogus {
+		probe = PROBE_BOGUS
+	}
+	return s.subdomains.Register(k, probe, f)
+}
+
+// RegisterQnameMinimisationProbe registers a subdomain whose children can be
+// queried to find out whether resolvers minimise query names (RFC 9156).
+func (s *DnsServer) RegisterQnameMinimisationProbe(k string, f func(Query)) (id uint64, inUse bool) {
+	return s.subdomains.Register(k, PROBE_ENT, f)
 }
 
-func (s *DnsServer) RegisterCallback(k uint32, f func(net.IP)) {
-	s.subdomains.Set(k, f, ttlcache.DefaultTTL)
+func (s *DnsServer) Unregister(k string, id uint64) {
+	s.subdomains.Unregister(k, id)
 }
 
-func (s *DnsServer) onRequest(domain string, ip net.IP) {
-	p := strings.Index(domain, s.topDomain)
-	if p < 1 {
-		return
+// onRequest notifies the observers of the token of domain, if any. It
+// returns the probe type of the token and the labels preceding it.
+func (s *DnsServer) onRequest(domain string, q Query) (probe int, labels []string, found bool) {
+	token, labels, ok := SplitName(domain, s.topDomain)
+	if !ok {
+		return PROBE_NONE, nil, false
 	}
-	subdomain := domain[:p-1]
-	if k, err := strconv.ParseUint(subdomain, 10, 32); err == nil {
-		entry := s.subdomains.Get(uint32(k))
-		if entry != nil {
-			entry.Value()(ip)
+	q.Token = token
+	q.Labels = labels
+	q.Subdomain = strings.Join(append(labels[:len(labels):len(labels)], token), ".")
+	probe, found = s.subdomains.Notify(token, q)
+	return probe, labels, found
+}
+
+// signed returns rrset along with its signature by signer if the DNSSEC OK
+// bit is set.
+func signed(signer *Signer, rrset []dns.RR, q Query, bogus bool) []dns.RR {
+	if len(rrset) == 0 || signer == nil || !q.DNSSECOk {
+		return rrset
+	}
+	sig, err := signer.sign(rrset, bogus)
+	if err != nil {
+		log.Println("DNS server: failed to sign records:", err)
+		return rrset
+	}
+	return append(rrset, sig)
+}
+
+// resolve returns the records of domain with type qtype, and the types of
+// the records domain has. exists is false if domain doesn't exist, in which
+// case NXDOMAIN must be returned.
+func (s *DnsServer) resolve(zone *Zone, signer *Signer, domain string, qtype uint16, q Query) (rrset []dns.RR, types []uint16, exists bool, bogus bool) {
+	apex := dns.Fqdn(s.topDomain)
+	if domain == apex {
+		types = []uint16{dns.TypeNS, dns.TypeSOA}
+		if signer != nil {
+			types = append(types, dns.TypeDNSKEY)
+		}
+		switch qtype {
+		case dns.TypeSOA:
+			return []dns.RR{zone.soa(apex)}, types, true, false
+		case dns.TypeNS:
+			return []dns.RR{zone.ns(apex)}, types, true, false
+		case dns.TypeDNSKEY:
+			if signer != nil {
+				return []dns.RR{signer.key}, types, true, false
+			}
+		}
+		return nil, types, true, false
+	}
+	if domain == dns.Fqdn(strings.ToLower(zone.Nameserver)) {
+		return zone.addressRecords(q.Name, qtype), zone.addressTypes(), true, false
+	}
+	probe, labels, found := s.onRequest(domain, q)
+	if found && probe == PROBE_ENT && len(labels) == 0 {
+		return nil, nil, true, false
+	}
+	if !found || (probe != PROBE_SIGNED && probe != PROBE_BOGUS && zone.Answer == ANSWER_NXDOMAIN) {
+		return nil, nil, false, false
+	}
+	return zone.addressRecords(q.Name, qtype), zone.addressTypes(), true, probe == PROBE_BOGUS
+}
+
+func (s *DnsServer) handle(w dns.ResponseWriter, m *dns.Msg) {
+	var q Query
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		q = Query{IP: addr.IP, Port: addr.Port, Transport: TRANSPORT_UDP}
+	case *net.TCPAddr:
+		q = Query{IP: addr.IP, Port: addr.Port, Transport: TRANSPORT_TCP}
+	}
+	q.Name = m.Question[0].Name
+	q.Type = m.Question[0].Qtype
+	q.ID = m.Id
+	r := dns.Msg{}
+	r.SetReply(m)
+	if opt := m.IsEdns0(); opt != nil {
+		q.EDNS = true
+		q.UDPSize = opt.UDPSize()
+		q.DNSSECOk = opt.Do()
+		resOpt := r.SetEdns0(dns.DefaultMsgSize, q.DNSSECOk).IsEdns0()
+		for _, o := range opt.Option {
+			if _, ok := o.(*dns.EDNS0_COOKIE); ok {
+				q.Cookie = true
+			}
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				q.ClientSubnet = &ClientSubnet{
+					Family:  ecs.Family,
+					Prefix:  ecs.SourceNetmask,
+					Address: ecs.Address,
+				}
+				// scope 0: the response is valid for any client subnet
+				resOpt.Option = append(resOpt.Option, &dns.EDNS0_SUBNET{
+					Code:          dns.EDNS0SUBNET,
+					Family:        ecs.Family,
+					SourceNetmask: ecs.SourceNetmask,
+					Address:       ecs.Address,
+				})
+			}
+		}
+	}
+	apex := dns.Fqdn(s.topDomain)
+	qtype := m.Question[0].Qtype
+	domain := strings.ToLower(q.Name)
+	zone, signer := s.zone.Load(), s.signer.Load()
+	rrset, types, exists, bogus := s.resolve(zone, signer, domain, qtype, q)
+	r.Authoritative = true
+	if len(rrset) == 0 && signer != nil && q.DNSSECOk {
+		// authenticated denial: a signed NSEC record proves that domain has
+		// no record of type qtype. Non-existent names are answered as if
+		// they had no records at all, which a single NSEC record can prove.
+		r.Ns = append(signed(signer, []dns.RR{zone.soa(apex)}, q, false), signed(signer, []dns.RR{blackLie(domain, types, zone.TTL)}, q, false)...)
+	} else if len(rrset) == 0 {
+		if !exists {
+			r.Rcode = dns.RcodeNameError
+		}
+		// NXDOMAIN or NODATA: the SOA allows negative caching
+		r.Ns = signed(signer, []dns.RR{zone.soa(apex)}, q, false)
+	} else {
+		r.Answer = signed(signer, rrset, q, bogus)
+		if qtype == dns.TypeNS {
+			r.Extra = append(r.Extra, zone.glue(apex)...)
 		}
 	}
+	w.WriteMsg(&r)
 }
 
+// Start listens for DNS requests on both UDP and TCP. Resolvers usually
+// fall back to TCP when UDP responses are truncated or blocked.
 func (s *DnsServer) Start(addr string) {
-	dns.HandleFunc(s.topDomain, func(w dns.ResponseWriter, m *dns.Msg) {
-		s.onRequest(strings.ToLower(m.Question[0].Name), w.RemoteAddr().(*net.UDPAddr).IP)
-		r := dns.Msg{}
-		r.SetReply(m)
-		r.Rcode = dns.RcodeNameError // avoid being queried again
-		w.WriteMsg(&r)
-	})
-	if err := (&dns.Server{Net: "udp", Addr: addr}).ListenAndServe(); err != nil {
-		log.Fatalln("Failed to start DNS server:", err)
+	mux := dns.NewServeMux()
+	mux.HandleFunc(s.topDomain, s.handle)
+	errs := make(chan error)
+	for _, transport := range []string{TRANSPORT_UDP, TRANSPORT_TCP} {
+		go func() {
+			errs <- (&dns.Server{Net: transport, Addr: addr, Handler: mux}).ListenAndServe()
+		}()
 	}
+	log.Fatalln("Failed to start DNS server:", <-errs)
 }
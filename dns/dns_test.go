@@ -1,10 +1,9 @@
 package dns
 
 import (
-	"math/rand"
 	"net"
 	"os"
-	"strconv"
+	"slices"
 	"testing"
 	"time"
 	"zeroleaks/utils"
@@ -23,68 +22,88 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
-func fullDomainFromKey(key uint32) string {
-	return strconv.FormatUint(uint64(key), 10) + "." + server.topDomain
+func randomToken() string {
+	return EncodeToken(utils.RandomBytes(MIN_TOKEN_SIZE))
+}
+
+func fullDomainFromKey(key string) string {
+	return key + "." + server.topDomain
 }
 
 func TestCallback(t *testing.T) {
 	ipv4 := utils.RandomIPv4()
 	ipv6 := utils.RandomIPv6()
 	expectedIP := ipv4
-	key := rand.Uint32()
-	server.RegisterCallback(key, func(ip net.IP) {
-		if !ip.Equal(expectedIP) {
-			utils.TErrorf(t, "Callback for subdomain %d called with wrong IP. Got %s, expected %s", key, ip, expectedIP)
+	key := randomToken()
+	server.RegisterCallback(key, func(q Query) {
+		if !q.IP.Equal(expectedIP) {
+			utils.TErrorf(t, "Callback for subdomain %s called with wrong IP. Got %s, expected %s", key, q.IP, expectedIP)
 		} else if expectedIP.Equal(ipv4) {
 			expectedIP = ipv6
 		} else {
 			expectedIP = nil
 		}
 	})
-	server.onRequest(invalidDomain, ipv6) // callback should not be triggered
-	server.onRequest("", ipv6)            // callback should not be triggered
+	observed := 0
+	id, inUse := server.RegisterCallback(key, func(q Query) {
+		observed++
+	})
+	if !inUse {
+		utils.TErrorf(t, "Subdomain %s not reported in use", key)
+	}
+	server.onRequest(invalidDomain, Query{IP: ipv6})                     // callback should not be triggered
+	server.onRequest("", Query{IP: ipv6})                                // callback should not be triggered
+	server.onRequest(fullDomainFromKey(key)+".evil", Query{IP: ipv6})    // callback should not be triggered
+	server.onRequest(key+".x"+server.topDomain, Query{IP: ipv6})         // callback should not be triggered
+	server.onRequest(key+"1."+server.topDomain, Query{IP: ipv6})         // callback should not be triggered
+	server.onRequest(key+"."+key+"x."+server.topDomain, Query{IP: ipv6}) // callback should not be triggered
 	domain := fullDomainFromKey(key)
-	server.onRequest(domain, expectedIP)
+	server.onRequest(domain, Query{IP: expectedIP})
 	if !expectedIP.Equal(ipv6) {
-		utils.TErrorf(t, "Callback for subdomain %d not called with IPv4: %s", key, ipv4)
+		utils.TErrorf(t, "Callback for subdomain %s not called with IPv4: %s", key, ipv4)
 	}
-	server.onRequest(domain, expectedIP)
+	server.onRequest(domain, Query{IP: expectedIP})
 	if expectedIP != nil {
-		utils.TErrorf(t, "Callback for subdomain %d not called with IPv6: %s", key, ipv6)
+		utils.TErrorf(t, "Callback for subdomain %s not called with IPv6: %s", key, ipv6)
+	}
+	server.onRequest(domain, Query{IP: expectedIP})
+	server.onRequest(invalidDomain, Query{IP: ipv4}) // callback should not be triggered
+	server.Unregister(key, id)
+	server.onRequest(domain, Query{IP: expectedIP})
+	if observed != 3 {
+		utils.TErrorf(t, "Second observer of subdomain %s called %d times, expected 3", key, observed)
 	}
-	server.onRequest(domain, expectedIP)
-	server.onRequest(invalidDomain, ipv4) // callback should not be triggered
 }
 
 func TestExpiration(t *testing.T) {
-	key := rand.Uint32()
-	server.RegisterCallback(key, func(ip net.IP) {
-		utils.TErrorf(t, "Callback for subdomain %d unexpectedly called with IP %s", key, ip)
+	key := randomToken()
+	server.RegisterCallback(key, func(q Query) {
+		utils.TErrorf(t, "Callback for subdomain %s unexpectedly called with IP %s", key, q.IP)
 	})
 	if !server.subdomains.Has(key) {
-		utils.TErrorf(t, "Subdomain %d not registered", key)
+		utils.TErrorf(t, "Subdomain %s not registered", key)
 	}
 	time.Sleep(timeout + 20*time.Millisecond) // add 20ms margin
 	if server.subdomains.Has(key) {
-		utils.TErrorf(t, "Subdomain %d not expired after %s", key, timeout)
+		utils.TErrorf(t, "Subdomain %s not expired after %s", key, timeout)
 	}
 
 	expectedIP := utils.RandomIPv4()
 	called := false
-	server.RegisterCallback(key, func(ip net.IP) {
+	server.RegisterCallback(key, func(q Query) {
 		called = true
-		if !ip.Equal(expectedIP) {
-			utils.TErrorf(t, "Callback for subdomain %d called with wrong IP. Got %s, expected %s", key, ip, expectedIP)
+		if !q.IP.Equal(expectedIP) {
+			utils.TErrorf(t, "Callback for subdomain %s called with wrong IP. Got %s, expected %s", key, q.IP, expectedIP)
 		}
 	})
 	time.Sleep(timeout - 20*time.Millisecond)
 	if !server.subdomains.Has(key) {
-		utils.TErrorf(t, "Subdomain %d expired before timeout", key)
+		utils.TErrorf(t, "Subdomain %s expired before timeout", key)
 	}
-	server.onRequest(fullDomainFromKey(key), expectedIP)
+	server.onRequest(fullDomainFromKey(key), Query{IP: expectedIP})
 	time.Sleep(40 * time.Millisecond)
 	if server.subdomains.Has(key) {
-		utils.TErrorf(t, "Subdomain %d not expired after more than %s passed", key, timeout)
+		utils.TErrorf(t, "Subdomain %s not expired after more than %s passed", key, timeout)
 	}
 	if !called {
 		utils.TErrorf(t, "Callback not triggered")
@@ -106,17 +125,82 @@ func query(t *testing.T, c *dns.Client, domain string, expectedRcode int) {
 func TestDnsServer(t *testing.T) {
 	go server.Start(addr)
 	time.Sleep(20 * time.Millisecond) // wait for the server to start
+	for _, transport := range []string{TRANSPORT_UDP, TRANSPORT_TCP} {
+		c := &dns.Client{Net: transport}
+		query(t, c, invalidDomain+".", dns.RcodeRefused)
+		query(t, c, ".", dns.RcodeRefused)
+		query(t, c, "unknown."+server.topDomain+".", dns.RcodeNameError)
+		key := randomToken()
+		requests := new(utils.Recorder[Query])
+		server.RegisterCallback(key, requests.Add)
+		query(t, c, fullDomainFromKey(key)+".", dns.RcodeNameError)
+		if len(requests.Get()) != 1 {
+			utils.TFatalf(t, "Callback called %d times, expected 1", len(requests.Get()))
+		}
+		request := requests.Get()[0]
+		if !request.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+			utils.TErrorf(t, "Invalid request IP: %s", request.IP)
+		}
+		if request.Transport != transport {
+			utils.TErrorf(t, "Invalid request transport: got %s, expected %s", request.Transport, transport)
+		}
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
 	c := new(dns.Client)
-	query(t, c, invalidDomain+".", dns.RcodeRefused)
-	query(t, c, ".", dns.RcodeRefused)
-	query(t, c, "unknown."+server.topDomain+".", dns.RcodeNameError)
-	key := rand.Uint32()
-	var requestIp net.IP
-	server.RegisterCallback(key, func(ip net.IP) {
-		requestIp = ip
+	key := randomToken()
+	requests := new(utils.Recorder[Query])
+	server.RegisterCallback(key, requests.Add)
+	m := new(dns.Msg)
+	m.SetQuestion(fullDomainFromKey(key)+".", dns.TypeA)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.IPv4(192, 0, 2, 0),
 	})
-	query(t, c, fullDomainFromKey(key)+".", dns.RcodeNameError)
-	if !requestIp.Equal(net.IPv4(127, 0, 0, 1)) {
-		utils.TErrorf(t, "Invalid request IP: %s", requestIp)
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		utils.TFatalf(t, "Client error: %s", err)
+	}
+	if len(requests.Get()) != 1 {
+		utils.TFatalf(t, "Callback called %d times, expected 1", len(requests.Get()))
+	}
+	request := requests.Get()[0]
+	if request.ClientSubnet == nil {
+		utils.TFatalf(t, "Client subnet not reported")
+	}
+	if request.ClientSubnet.Family != 1 || request.ClientSubnet.Prefix != 24 || !request.ClientSubnet.Address.Equal(net.IPv4(192, 0, 2, 0)) {
+		utils.TErrorf(t, "Invalid client subnet: %+v", request.ClientSubnet)
+	}
+	if r.IsEdns0() == nil {
+		utils.TErrorf(t, "Response does not contain an OPT record")
+	}
+}
+
+func TestSplitName(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		token  string
+		labels []string
+		ok     bool
+	}{
+		{name: "abc.test.", token: "abc", labels: []string{}, ok: true},
+		{name: "abc.test", token: "abc", labels: []string{}, ok: true},
+		{name: "x.y.abc234.test.", token: "abc234", labels: []string{"x", "y"}, ok: true},
+		{name: "test."},
+		{name: "abc.xtest."},
+		{name: "abc.test.evil.com."},
+		{name: "abc1.test."},
+		{name: "abc.-.test."},
+		{name: "abc-.test."},
+	} {
+		token, labels, ok := SplitName(c.name, "test")
+		if ok != c.ok || token != c.token || (ok && !slices.Equal(labels, c.labels)) {
+			utils.TErrorf(t, "Invalid split of %s: got %q %q %t, expected %q %q %t", c.name, token, labels, ok, c.token, c.labels, c.ok)
+		}
 	}
 }
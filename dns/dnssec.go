@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DNSKEY_TTL         = 3600
+	SIGNATURE_VALIDITY = 7 * 24 * time.Hour
+)
+
+// Signer signs records of the zone on the fly.
+type Signer struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+// LoadSigner reads the zone key from path.key and path.private, in the same
+// format as BIND's dnssec-keygen. A new key is generated if it doesn't exist.
+func LoadSigner(zone, path string) (*Signer, error) {
+	pubPath, privPath := path+".key", path+".private"
+	if _, err := os.Stat(privPath); errors.Is(err, fs.ErrNotExist) {
+		if err := generateKey(zone, pubPath, privPath); err != nil {
+			return nil, err
+		}
+	}
+	pub, err := os.ReadFile(pubPath)
+	if err != nil {
+		return nil, err
+	}
+	rr, err := dns.NewRR(string(pub))
+	if err != nil {
+		return nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok || key.Hdr.Name != dns.Fqdn(zone) {
+		return nil, errors.New(pubPath + " does not contain a DNSKEY record for " + zone)
+	}
+	f, err := os.Open(privPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	priv, err := key.ReadPrivateKey(f, privPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{key: key, priv: priv.(crypto.Signer)}, nil
+}
+
+func generateKey(zone, pubPath, privPath string) error {
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(zone),
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    DNSKEY_TTL,
+		},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(privPath, []byte(key.PrivateKeyString(priv)), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(pubPath, []byte(key.String()+"\n"), 0644)
+}
+
+// DS returns the record to publish in the parent zone to establish the
+// chain of trust.
+func (s *Signer) DS() *dns.DS {
+	return s.key.ToDS(dns.SHA256)
+}
+
+// sign returns the signature of rrset. If bogus is true, the signature is
+// deliberately corrupted so that validating resolvers reject the records.
+func (s *Signer) sign(rrset []dns.RR, bogus bool) (*dns.RRSIG, error) {
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		KeyTag:     s.key.KeyTag(),
+		SignerName: s.key.Hdr.Name,
+		Algorithm:  s.key.Algorithm,
+		Inception:  uint32(now.Add(-time.Hour).Unix()), // tolerate clock skew
+		Expiration: uint32(now.Add(SIGNATURE_VALIDITY).Unix()),
+	}
+	if err := sig.Sign(s.priv, rrset); err != nil {
+		return nil, err
+	}
+	if bogus {
+		signature, err := base64.StdEncoding.DecodeString(sig.Signature)
+		if err != nil {
+			return nil, err
+		}
+		signature[0] ^= 0xff
+		sig.Signature = base64.StdEncoding.EncodeToString(signature)
+	}
+	return sig, nil
+}
+
+// blackLie returns a minimal NSEC record for name, whose next name is its
+// immediate successor, and which lists types and the DNSSEC records. It
+// proves that name has no record of any other type without enumerating the
+// zone, and is used for non-existent names as well (RFC 4470).
+func blackLie(name string, types []uint16, ttl uint32) *dns.NSEC {
+	bitmap := append([]uint16{dns.TypeRRSIG, dns.TypeNSEC}, types...)
+	slices.Sort(bitmap)
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: "\\000." + name,
+		TypeBitMap: slices.Compact(bitmap),
+	}
+}
@@ -0,0 +1,152 @@
+package dns
+
+import (
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"zeroleaks/utils"
+
+	"github.com/miekg/dns"
+)
+
+func queryDNSSEC(t *testing.T, domain string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(domain, qtype)
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	r, _, err := new(dns.Client).Exchange(m, addr)
+	if err != nil {
+		utils.TFatalf(t, "Client error: %s", err)
+	}
+	return r
+}
+
+// verify checks the signature of every RRset of records.
+func verify(t *testing.T, key *dns.DNSKEY, records []dns.RR) error {
+	rrsets := make(map[uint16][]dns.RR)
+	sigs := make(map[uint16]*dns.RRSIG)
+	for _, rr := range records {
+		if s, ok := rr.(*dns.RRSIG); ok {
+			sigs[s.TypeCovered] = s
+		} else {
+			rrsets[rr.Header().Rrtype] = append(rrsets[rr.Header().Rrtype], rr)
+		}
+	}
+	if len(rrsets) == 0 {
+		utils.TFatalf(t, "Missing records in response: %v", records)
+	}
+	for rrtype, rrset := range rrsets {
+		sig, ok := sigs[rrtype]
+		if !ok {
+			utils.TFatalf(t, "Missing signature of %s records: %v", dns.TypeToString[rrtype], records)
+		}
+		if err := sig.Verify(key, rrset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestDNSSEC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnssec")
+	signer, err := LoadSigner(server.topDomain, path)
+	if err != nil {
+		utils.TFatalf(t, "Failed to generate DNSSEC key: %s", err)
+	}
+	reloaded, err := LoadSigner(server.topDomain, path)
+	if err != nil {
+		utils.TFatalf(t, "Failed to load DNSSEC key: %s", err)
+	}
+	if reloaded.key.PublicKey != signer.key.PublicKey {
+		utils.TErrorf(t, "Reloaded key differs from the generated one")
+	}
+	server.EnableDNSSEC(signer)
+	server.SetZone(Zone{Answer: ANSWER_NXDOMAIN, TTL: DEFAULT_TTL, Addresses: []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")}})
+	defer server.EnableDNSSEC(nil)
+	defer server.SetZone(Zone{Answer: ANSWER_NXDOMAIN, TTL: DEFAULT_TTL})
+
+	r := queryDNSSEC(t, server.topDomain+".", dns.TypeDNSKEY)
+	if err := verify(t, signer.key, r.Answer); err != nil {
+		utils.TErrorf(t, "Invalid DNSKEY signature: %s", err)
+	}
+
+	signed := randomToken()
+	bogus := randomToken()
+	requests := new(utils.Recorder[Query])
+	server.RegisterDNSSECProbe(signed, false, requests.Add)
+	server.RegisterDNSSECProbe(bogus, true, requests.Add)
+	r = queryDNSSEC(t, fullDomainFromKey(signed)+".", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || !r.Authoritative {
+		utils.TErrorf(t, "Invalid response for signed probe: %s", r)
+	}
+	if err := verify(t, signer.key, r.Answer); err != nil {
+		utils.TErrorf(t, "Invalid signature for signed probe: %s", err)
+	}
+	r = queryDNSSEC(t, fullDomainFromKey(signed)+".", dns.TypeAAAA)
+	if err := verify(t, signer.key, r.Answer); err != nil {
+		utils.TErrorf(t, "Invalid AAAA signature for signed probe: %s", err)
+	}
+	r = queryDNSSEC(t, fullDomainFromKey(bogus)+".", dns.TypeA)
+	if err := verify(t, signer.key, r.Answer); err == nil {
+		utils.TErrorf(t, "Bogus probe has a valid signature")
+	}
+	if called := len(requests.Get()); called != 3 {
+		utils.TErrorf(t, "Probe callbacks called %d times, expected 3", called)
+	}
+}
+
+func TestAuthenticatedDenial(t *testing.T) {
+	signer, err := LoadSigner(server.topDomain, filepath.Join(t.TempDir(), "dnssec"))
+	if err != nil {
+		utils.TFatalf(t, "Failed to generate DNSSEC key: %s", err)
+	}
+	server.EnableDNSSEC(signer)
+	server.SetZone(Zone{Answer: ANSWER_NXDOMAIN, TTL: DEFAULT_TTL, Nameserver: "ns." + server.topDomain, Addresses: []net.IP{net.IPv4(192, 0, 2, 1)}})
+	defer server.EnableDNSSEC(nil)
+	defer server.SetZone(Zone{Answer: ANSWER_NXDOMAIN, TTL: DEFAULT_TTL})
+	token := randomToken()
+	server.RegisterCallback(token, func(Query) {})
+	minimisation := randomToken()
+	server.RegisterQnameMinimisationProbe(minimisation, func(Query) {})
+
+	for _, c := range []struct {
+		domain string
+		qtype  uint16
+		types  []uint16
+	}{
+		// test tokens don't exist in nxdomain mode
+		{domain: fullDomainFromKey(token) + ".", qtype: dns.TypeA},
+		{domain: fullDomainFromKey(randomToken()) + ".", qtype: dns.TypeA},
+		{domain: server.topDomain + ".", qtype: dns.TypeA, types: []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeDNSKEY}},
+		{domain: fullDomainFromKey(minimisation) + ".", qtype: dns.TypeA},
+		{domain: "ns." + server.topDomain + ".", qtype: dns.TypeAAAA, types: []uint16{dns.TypeA}},
+	} {
+		r := queryDNSSEC(t, c.domain, c.qtype)
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+			utils.TErrorf(t, "Invalid negative answer for %s: %s", c.domain, r)
+			continue
+		}
+		if err := verify(t, signer.key, r.Ns); err != nil {
+			utils.TErrorf(t, "Invalid signature of the negative answer for %s: %s", c.domain, err)
+		}
+		var nsec *dns.NSEC
+		for _, rr := range r.Ns {
+			if n, ok := rr.(*dns.NSEC); ok {
+				nsec = n
+			}
+		}
+		if nsec == nil || nsec.Hdr.Name != c.domain || nsec.NextDomain != "\\000."+c.domain {
+			utils.TErrorf(t, "Invalid NSEC record for %s: %v", c.domain, nsec)
+			continue
+		}
+		expected := append([]uint16{dns.TypeRRSIG, dns.TypeNSEC}, c.types...)
+		slices.Sort(expected)
+		if !slices.Equal(nsec.TypeBitMap, expected) {
+			utils.TErrorf(t, "Invalid NSEC types for %s: got %v, expected %v", c.domain, nsec.TypeBitMap, expected)
+		}
+	}
+	// resolvers which don't validate still get NXDOMAIN
+	if r := exchange(t, fullDomainFromKey(token)+".", dns.TypeA); r.Rcode != dns.RcodeNameError {
+		utils.TErrorf(t, "Invalid response without the DNSSEC OK bit: %s", r)
+	}
+}
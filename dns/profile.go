@@ -0,0 +1,134 @@
+package dns
+
+import (
+	"math"
+	"strings"
+	"sync"
+)
+
+// Spread summarizes how random a set of values is, such as the source
+// ports or the message IDs chosen by a resolver.
+type Spread struct {
+	Samples  int     `json:"samples"`
+	Distinct int     `json:"distinct"`
+	Min      int     `json:"min"`
+	Max      int     `json:"max"`
+	StdDev   float64 `json:"stddev"`
+}
+
+func newSpread(values []int) Spread {
+	spread := Spread{Samples: len(values)}
+	if len(values) == 0 {
+		return spread
+	}
+	distinct := make(map[int]struct{})
+	spread.Min, spread.Max = values[0], values[0]
+	sum := 0.0
+	for _, v := range values {
+		distinct[v] = struct{}{}
+		spread.Min = min(spread.Min, v)
+		spread.Max = max(spread.Max, v)
+		sum += float64(v)
+	}
+	spread.Distinct = len(distinct)
+	mean := sum / float64(len(values))
+	variance := 0.0
+	for _, v := range values {
+		variance += (float64(v) - mean) * (float64(v) - mean)
+	}
+	spread.StdDev = math.Sqrt(variance / float64(len(values)))
+	return spread
+}
+
+// ResolverFingerprint describes the hardening measures observed in the
+// queries of a leak test session.
+type ResolverFingerprint struct {
+	Queries int `json:"queries"`
+	// CaseRandomized is true if the resolver uses 0x20 encoding, i.e. mixes
+	// the case of the query names.
+	CaseRandomized bool `json:"case_randomized"`
+	// SourcePorts only accounts for UDP queries.
+	SourcePorts Spread `json:"source_ports"`
+	MessageIDs  Spread `json:"message_ids"`
+	EDNS        bool   `json:"edns"`
+	UDPSize     uint16 `json:"udp_size"`
+	DNSSECOk    bool   `json:"dnssec_ok"`
+	Cookie      bool   `json:"cookie"`
+}
+
+// ResolverProfile accumulates the queries of a leak test session. It is safe
+// for concurrent use.
+type ResolverProfile struct {
+	mutex       sync.Mutex
+	fingerprint ResolverFingerprint
+	ports       []int
+	ids         []int
+}
+
+func (p *ResolverProfile) Add(q Query) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	f := &p.fingerprint
+	f.Queries++
+	// the case of the zone is left out, as resolvers may keep the one of
+	// its delegation
+	if sub := q.Name[:min(len(q.Subdomain), len(q.Name))]; sub != strings.ToLower(sub) {
+		f.CaseRandomized = true
+	}
+	if q.Transport == TRANSPORT_UDP {
+		p.ports = append(p.ports, q.Port)
+	}
+	p.ids = append(p.ids, int(q.ID))
+	if q.EDNS {
+		f.EDNS = true
+		f.UDPSize = max(f.UDPSize, q.UDPSize)
+		f.DNSSECOk = f.DNSSECOk || q.DNSSECOk
+		f.Cookie = f.Cookie || q.Cookie
+	}
+}
+
+func (p *ResolverProfile) Fingerprint() ResolverFingerprint {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	f := p.fingerprint
+	f.SourcePorts = newSpread(p.ports)
+	f.MessageIDs = newSpread(p.ids)
+	return f
+}
+
+// QnameMinimisation finds out whether resolvers minimise query names (RFC
+// 9156) from the queries received for a multi-label test subdomain. It is
+// safe for concurrent use.
+type QnameMinimisation struct {
+	mutex     sync.Mutex
+	subdomain string
+	full      bool
+	minimised bool
+}
+
+func NewQnameMinimisation(subdomain string) *QnameMinimisation {
+	return &QnameMinimisation{subdomain: strings.ToLower(subdomain)}
+}
+
+func (m *QnameMinimisation) Add(q Query) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if q.Subdomain == m.subdomain {
+		m.full = true
+	} else if strings.HasSuffix(m.subdomain, "."+strings.TrimPrefix(q.Subdomain, "_.")) {
+		// query for an ancestor of the test subdomain
+		m.minimised = true
+	}
+}
+
+// Result returns nil if no query has been received for the test subdomain
+// or its ancestors.
+func (m *QnameMinimisation) Result() *bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.full && !m.minimised {
+		return nil
+	}
+	minimised := m.minimised
+	return &minimised
+}
@@ -0,0 +1,56 @@
+package dns
+
+import (
+	"testing"
+	"zeroleaks/utils"
+)
+
+func TestResolverProfile(t *testing.T) {
+	var p ResolverProfile
+	f := p.Fingerprint()
+	if f.Queries != 0 || f.SourcePorts.Samples != 0 || f.CaseRandomized {
+		utils.TErrorf(t, "Invalid empty fingerprint: %+v", f)
+	}
+	p.Add(Query{Name: "a.TEST.", Subdomain: "a", Port: 1000, ID: 1, Transport: TRANSPORT_UDP})
+	if p.Fingerprint().CaseRandomized {
+		utils.TErrorf(t, "Case of the zone reported as randomized")
+	}
+	p.Add(Query{Name: "xY.tEsT.", Subdomain: "xy", Port: 3000, ID: 1, Transport: TRANSPORT_UDP, EDNS: true, UDPSize: 1232, DNSSECOk: true})
+	p.Add(Query{Name: "c.test.", Subdomain: "c", Port: 50000, ID: 7, Transport: TRANSPORT_TCP, EDNS: true, UDPSize: 512, Cookie: true})
+	f = p.Fingerprint()
+	if f.Queries != 3 {
+		utils.TErrorf(t, "Invalid number of queries: got %d, expected 3", f.Queries)
+	}
+	if !f.CaseRandomized {
+		utils.TErrorf(t, "Case randomization not detected")
+	}
+	if f.SourcePorts != (Spread{Samples: 2, Distinct: 2, Min: 1000, Max: 3000, StdDev: 1000}) {
+		utils.TErrorf(t, "Invalid source ports spread: %+v", f.SourcePorts)
+	}
+	if f.MessageIDs.Samples != 3 || f.MessageIDs.Distinct != 2 || f.MessageIDs.Min != 1 || f.MessageIDs.Max != 7 {
+		utils.TErrorf(t, "Invalid message IDs spread: %+v", f.MessageIDs)
+	}
+	if !f.EDNS || f.UDPSize != 1232 || !f.DNSSECOk || !f.Cookie {
+		utils.TErrorf(t, "Invalid EDNS fingerprint: %+v", f)
+	}
+}
+
+func TestQnameMinimisation(t *testing.T) {
+	m := NewQnameMinimisation("1.2")
+	if m.Result() != nil {
+		utils.TErrorf(t, "Result available before any query")
+	}
+	m.Add(Query{Subdomain: "3"})
+	m.Add(Query{Subdomain: "1.2"})
+	if r := m.Result(); r == nil || *r {
+		utils.TErrorf(t, "Minimisation detected without partial query")
+	}
+	for _, partial := range []string{"2", "_.2"} {
+		m = NewQnameMinimisation("1.2")
+		m.Add(Query{Subdomain: partial})
+		m.Add(Query{Subdomain: "1.2"})
+		if r := m.Result(); r == nil || !*r {
+			utils.TErrorf(t, "Minimisation not detected with partial query %s", partial)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package dns
+
+import (
+	"encoding/base32"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// 128 bits, so that tokens of other sessions can't be guessed
+	MIN_TOKEN_SIZE = 16
+	// a label can't be longer than 63 characters once encoded
+	MAX_TOKEN_SIZE = 39
+)
+
+// Tokens identify registered subdomains. They are encoded in lowercase
+// base32, which only uses characters allowed in hostnames and survives the
+// case randomization applied by some resolvers.
+var tokenEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+func EncodeToken(b []byte) string {
+	return tokenEncoding.EncodeToString(b)
+}
+
+func isToken(label string) bool {
+	if label == "" {
+		return false
+	}
+	for _, c := range label {
+		if (c < 'a' || c > 'z') && (c < '2' || c > '7') {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitName parses name, which must be lowercase, into the token right
+// before zone and the labels preceding it. ok is false if name is not a
+// subdomain of zone or if its token is not valid.
+func SplitName(name, zone string) (token string, labels []string, ok bool) {
+	subdomain, found := strings.CutSuffix(dns.Fqdn(name), "."+dns.Fqdn(strings.ToLower(zone)))
+	if !found {
+		return "", nil, false
+	}
+	labels = strings.Split(subdomain, ".")
+	token = labels[len(labels)-1]
+	if !isToken(token) {
+		return "", nil, false
+	}
+	return token, labels[:len(labels)-1], true
+}
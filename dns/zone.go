@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// registered subdomains don't exist, so that resolvers don't cache them
+	ANSWER_NXDOMAIN = "nxdomain"
+	// registered subdomains resolve to the server addresses
+	ANSWER_ADDRESS = "address"
+
+	DEFAULT_TTL = 60
+)
+
+// Zone describes the records served by the DNS server.
+type Zone struct {
+	// Answer is either ANSWER_NXDOMAIN or ANSWER_ADDRESS.
+	Answer string
+	TTL    uint32
+	// Nameserver is the hostname of the server, as published in the NS
+	// record of the parent zone. If it is inside the zone, it resolves to
+	// Addresses, which are also served as glue.
+	Nameserver string
+	Addresses  []net.IP
+}
+
+// addressRecords returns the A or AAAA records of the server addresses.
+func (z *Zone) addressRecords(name string, qtype uint16) []dns.RR {
+	var records []dns.RR
+	for _, ip := range z.Addresses {
+		hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: z.TTL}
+		if ip4 := ip.To4(); ip4 != nil && qtype == dns.TypeA {
+			records = append(records, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && qtype == dns.TypeAAAA {
+			records = append(records, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return records
+}
+
+// NeedsAddresses is true if the zone of domain can't be served without
+// Addresses: in ANSWER_ADDRESS mode, or if the nameserver is inside the zone.
+func (z *Zone) NeedsAddresses(domain string) bool {
+	return z.Answer == ANSWER_ADDRESS || dns.IsSubDomain(dns.Fqdn(domain), dns.Fqdn(z.Nameserver))
+}
+
+// addressTypes returns the types of the address records of the server.
+func (z *Zone) addressTypes() []uint16 {
+	var types []uint16
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if len(z.addressRecords(".", qtype)) != 0 {
+			types = append(types, qtype)
+		}
+	}
+	return types
+}
+
+func (z *Zone) soa(apex string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: apex, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: z.TTL},
+		Ns:      dns.Fqdn(z.Nameserver),
+		Mbox:    "hostmaster." + apex,
+		Serial:  uint32(time.Now().Unix()), // the zone is generated on the fly
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  z.TTL,
+	}
+}
+
+func (z *Zone) ns(apex string) *dns.NS {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: apex, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: z.TTL},
+		Ns:  dns.Fqdn(z.Nameserver),
+	}
+}
+
+// glue returns the address records of the nameserver if it is inside the
+// zone.
+func (z *Zone) glue(apex string) []dns.RR {
+	ns := dns.Fqdn(z.Nameserver)
+	if !dns.IsSubDomain(apex, ns) {
+		return nil
+	}
+	return append(z.addressRecords(ns, dns.TypeA), z.addressRecords(ns, dns.TypeAAAA)...)
+}
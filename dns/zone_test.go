@@ -0,0 +1,141 @@
+package dns
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"zeroleaks/utils"
+
+	"github.com/miekg/dns"
+)
+
+func exchange(t *testing.T, domain string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(domain, qtype)
+	r, _, err := new(dns.Client).Exchange(m, addr)
+	if err != nil {
+		utils.TFatalf(t, "Client error: %s", err)
+	}
+	return r
+}
+
+func TestAddressAnswers(t *testing.T) {
+	server.SetZone(Zone{
+		Answer:     ANSWER_ADDRESS,
+		TTL:        42,
+		Nameserver: "ns.example",
+		Addresses:  []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")},
+	})
+	defer server.SetZone(Zone{Answer: ANSWER_NXDOMAIN, TTL: DEFAULT_TTL})
+
+	key := randomToken()
+	requests := new(utils.Recorder[Query])
+	server.RegisterCallback(key, requests.Add)
+	r := exchange(t, fullDomainFromKey(key)+".", dns.TypeA)
+	if r.Rcode != dns.RcodeSuccess || !r.Authoritative || len(r.Answer) != 1 {
+		utils.TFatalf(t, "Invalid A response: %s", r)
+	}
+	if a := r.Answer[0].(*dns.A); !a.A.Equal(net.IPv4(192, 0, 2, 1)) || a.Hdr.Ttl != 42 {
+		utils.TErrorf(t, "Invalid A record: %s", a)
+	}
+	r = exchange(t, fullDomainFromKey(key)+".", dns.TypeAAAA)
+	if len(r.Answer) != 1 || !r.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("2001:db8::1")) {
+		utils.TErrorf(t, "Invalid AAAA response: %s", r)
+	}
+	if len(requests.Get()) == 0 {
+		utils.TErrorf(t, "Callback not triggered")
+	}
+	query(t, new(dns.Client), "unknown."+server.topDomain+".", dns.RcodeNameError)
+
+	r = exchange(t, server.topDomain+".", dns.TypeSOA)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.SOA).Ns != "ns.example." {
+		utils.TErrorf(t, "Invalid SOA response: %s", r)
+	}
+	r = exchange(t, server.topDomain+".", dns.TypeNS)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.NS).Ns != "ns.example." {
+		utils.TErrorf(t, "Invalid NS response: %s", r)
+	}
+}
+
+func TestAuthoritativeAnswers(t *testing.T) {
+	nameserver := "ns." + server.topDomain + "."
+	server.SetZone(Zone{
+		Answer:     ANSWER_NXDOMAIN,
+		TTL:        DEFAULT_TTL,
+		Nameserver: nameserver,
+		Addresses:  []net.IP{net.IPv4(192, 0, 2, 1)},
+	})
+	defer server.SetZone(Zone{Answer: ANSWER_NXDOMAIN, TTL: DEFAULT_TTL})
+
+	r := exchange(t, server.topDomain+".", dns.TypeNS)
+	if !r.Authoritative || len(r.Answer) != 1 || r.Answer[0].(*dns.NS).Ns != nameserver {
+		utils.TErrorf(t, "Invalid NS response: %s", r)
+	}
+	if len(r.Extra) != 1 || r.Extra[0].Header().Name != nameserver || !r.Extra[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, 1)) {
+		utils.TErrorf(t, "Invalid glue: %s", r)
+	}
+	r = exchange(t, nameserver, dns.TypeA)
+	if len(r.Answer) != 1 {
+		utils.TErrorf(t, "Nameserver address not served: %s", r)
+	}
+	r = exchange(t, server.topDomain+".", dns.TypeSOA)
+	if !r.Authoritative || len(r.Answer) != 1 {
+		utils.TErrorf(t, "Invalid SOA response: %s", r)
+	}
+
+	assertNegative := func(domain string, qtype uint16, rcode int) {
+		r := exchange(t, domain, qtype)
+		if r.Rcode != rcode || !r.Authoritative || len(r.Answer) != 0 {
+			utils.TErrorf(t, "Invalid negative response for %s, expected rcode %d: %s", domain, rcode, r)
+		}
+		if len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+			utils.TErrorf(t, "Missing SOA in negative response for %s: %s", domain, r)
+		}
+	}
+	assertNegative(server.topDomain+".", dns.TypeTXT, dns.RcodeSuccess)
+	assertNegative(nameserver, dns.TypeAAAA, dns.RcodeSuccess)
+	assertNegative("unknown."+server.topDomain+".", dns.TypeA, dns.RcodeNameError)
+
+	key := randomToken()
+	requests := new(utils.Recorder[Query])
+	server.RegisterCallback(key, requests.Add)
+	assertNegative(fullDomainFromKey(key)+".", dns.TypeA, dns.RcodeNameError)
+	server.SetZone(Zone{Answer: ANSWER_ADDRESS, TTL: DEFAULT_TTL, Nameserver: nameserver, Addresses: []net.IP{net.IPv4(192, 0, 2, 1)}})
+	assertNegative(fullDomainFromKey(key)+".", dns.TypeAAAA, dns.RcodeSuccess)
+	if called := len(requests.Get()); called != 2 {
+		utils.TErrorf(t, "Callback called %d times, expected 2", called)
+	}
+}
+
+func TestEmptyNonTerminal(t *testing.T) {
+	key := randomToken()
+	requests := new(utils.Recorder[Query])
+	server.RegisterQnameMinimisationProbe(key, requests.Add)
+	c := new(dns.Client)
+	query(t, c, fullDomainFromKey(key)+".", dns.RcodeSuccess)
+	query(t, c, "_."+fullDomainFromKey(key)+".", dns.RcodeNameError)
+	query(t, c, "1."+fullDomainFromKey(key)+".", dns.RcodeNameError)
+	var subdomains []string
+	for _, q := range requests.Get() {
+		subdomains = append(subdomains, q.Subdomain)
+	}
+	expected := []string{key, "_." + key, "1." + key}
+	if !slices.Equal(subdomains, expected) {
+		utils.TErrorf(t, "Invalid subdomains received: got %v, expected %v", subdomains, expected)
+	}
+}
+
+func TestNeedsAddresses(t *testing.T) {
+	for _, c := range []struct {
+		zone     Zone
+		expected bool
+	}{
+		{zone: Zone{Answer: ANSWER_NXDOMAIN, Nameserver: "zeroleaks.org"}, expected: false},
+		{zone: Zone{Answer: ANSWER_ADDRESS, Nameserver: "zeroleaks.org"}, expected: true},
+		{zone: Zone{Answer: ANSWER_NXDOMAIN, Nameserver: "ns.dns.zeroleaks.org"}, expected: true},
+	} {
+		if c.zone.NeedsAddresses("dns.zeroleaks.org") != c.expected {
+			utils.TErrorf(t, "Invalid result for %+v: expected %t", c.zone, c.expected)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const PROTOCOL_HTTPS = "https"
+
+// Headers revealing the proxies between the client and the helper.
+var proxyHeaders = []string{"Via", "Forwarded", "X-Forwarded-For", "X-Real-IP", "Client-IP"}
+
+// echoParams tells the client where to send echo requests: to
+// /v2/echo/<token> on each of hosts, which may resolve to a single address
+// family.
+type echoParams struct {
+	Token string   `json:"token"`
+	Hosts []string `json:"hosts"`
+}
+
+// echoResult describes an echo request, as seen by the helper. It is both the
+// response of the echo endpoint and the leak reported to the test.
+type echoResult struct {
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+	Host     string `json:"host"`
+	Protocol string `json:"protocol"`
+	// HTTPVersion is the protocol of the request, such as HTTP/1.1.
+	HTTPVersion string `json:"http_version"`
+	TLSVersion  string `json:"tls_version,omitempty"`
+	// Headers holds the proxy headers of the request.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// echoProbes maps echo tokens to the callbacks to call when an echo request is
+// received for them.
+var echoProbes sync.Map
+
+// registerEcho returns the echo parameters of a test, whose echo requests are
+// reported through ipSender until it stops.
+func registerEcho(ipSender *IPSender) echoParams {
+	params := echoParams{Token: randomToken()}
+	for _, host := range []string{conf.Host, conf.IPv4Host, conf.IPv6Host} {
+		if host != "" {
+			params.Hosts = append(params.Hosts, host)
+		}
+	}
+	echoProbes.Store(params.Token, ipSender.SendEcho)
+	ipSender.OnClose(func() { echoProbes.Delete(params.Token) })
+	return params
+}
+
+// httpEcho responds to requests for /v2/echo/<token> with what the helper
+// sees of them, if token belongs to a running test.
+func httpEcho(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	f, ok := echoProbes.Load(r.PathValue("token"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	ip, port := clientAddr(r)
+	if ip == nil {
+		log.Println(WS_LOG_TAG, "invalid remote address:", r.RemoteAddr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	result := echoResult{IP: ip.String(), Port: port, Host: r.Host, Protocol: PROTOCOL_HTTP, HTTPVersion: r.Proto}
+	if r.TLS != nil {
+		result.Protocol = PROTOCOL_HTTPS
+		result.TLSVersion = tls.VersionName(r.TLS.Version)
+	}
+	for _, header := range proxyHeaders {
+		if value := r.Header.Values(header); len(value) != 0 {
+			if result.Headers == nil {
+				result.Headers = make(map[string]string)
+			}
+			result.Headers[strings.ToLower(header)] = strings.Join(value, ", ")
+		}
+	}
+	f.(func(*echoResult))(&result)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// SendEcho reports an echo request. Requests through different hosts are
+// reported separately, as they can reveal addresses of different families.
+func (s *IPSender) SendEcho(result *echoResult) {
+	event := &leakEvent{
+		IP:       result.IP,
+		Port:     result.Port,
+		Protocol: result.Protocol,
+		Metadata: map[string]any{"host": result.Host, "http_version": result.HTTPVersion},
+	}
+	if result.TLSVersion != "" {
+		event.Metadata["tls_version"] = result.TLSVersion
+	}
+	if result.Headers != nil {
+		event.Metadata["headers"] = result.Headers
+	}
+	s.leak("echo "+result.Host+" "+result.IP, result, event)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"zeroleaks/utils"
+
+	"github.com/coder/websocket"
+)
+
+func sendEcho(host string, token string, t *testing.T) (*http.Response, *echoResult) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/v2/echo/"+token, nil)
+	if err != nil {
+		utils.TFatalf(t, "Failed to create echo request: %s", err)
+	}
+	req.Host = host
+	req.Header.Add("X-Forwarded-For", "192.0.2.1")
+	req.Header.Add("X-Forwarded-For", "198.51.100.1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		utils.TFatalf(t, "Echo request failed: %s", err)
+	}
+	defer res.Body.Close()
+	result := new(echoResult)
+	if res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+			utils.TFatalf(t, "Failed to decode echo response: %s", err)
+		}
+	}
+	return res, result
+}
+
+func TestEcho(t *testing.T) {
+	conf.BitTorrent.Timeout = timeout
+	conf.Host = "test"
+	conf.IPv4Host = "ipv4.test"
+	defer func() { conf.IPv4Host = "" }()
+	bittorrentTracker = newMockTracker()
+	ws := wsConnectVersion(PROTOCOL_V2, "bittorrent", t)
+	params := struct {
+		paramsMessage
+		Params bittorrentTestParams `json:"params"`
+	}{}
+	ws.readJson(&params, t)
+	echo := params.Params.Echo
+	if echo.Token == "" || len(echo.Hosts) != 2 || echo.Hosts[0] != "test" || echo.Hosts[1] != "ipv4.test" {
+		utils.TFatalf(t, "Invalid echo params: %+v", echo)
+	}
+
+	var ports []int
+	for _, host := range []string{"test", "ipv4.test", "test"} {
+		res, result := sendEcho(host, echo.Token, t)
+		ports = append(ports, result.Port)
+		if res.StatusCode != http.StatusOK || res.Header.Get("Access-Control-Allow-Origin") != "*" {
+			utils.TFatalf(t, "Invalid echo response: %d %v", res.StatusCode, res.Header)
+		}
+		if result.IP != "127.0.0.1" || result.Port == 0 || result.Host != host || result.Protocol != PROTOCOL_HTTP || result.HTTPVersion != "HTTP/1.1" || result.TLSVersion != "" {
+			utils.TErrorf(t, "Invalid echo result: %+v", result)
+		}
+		if result.Headers["x-forwarded-for"] != "192.0.2.1, 198.51.100.1" || len(result.Headers) != 1 {
+			utils.TErrorf(t, "Invalid echo headers: %v", result.Headers)
+		}
+	}
+	// the second request through the same host is not reported again
+	for i, host := range []string{"test", "ipv4.test"} {
+		event := ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_BITTORRENT, IP: "127.0.0.1", Port: ports[i], Protocol: PROTOCOL_HTTP}, t)
+		if event.Metadata["host"] != host || event.Metadata["http_version"] != "HTTP/1.1" {
+			utils.TErrorf(t, "Invalid echo metadata: %v", event.Metadata)
+		}
+	}
+	done := new(doneMessage)
+	ws.readJson(done, t)
+	if done.Leaks != 2 {
+		utils.TErrorf(t, "Invalid done message: %+v", done)
+	}
+	if verdict := ws.readVerdict(t); verdict.Leaked || len(verdict.Addresses) != 0 {
+		utils.TErrorf(t, "Client address reported in the verdict: %+v", verdict)
+	}
+	ws.assertEnd(conf.BitTorrent.Timeout, t)
+
+	if res, _ := sendEcho("test", echo.Token, t); res.StatusCode != http.StatusNotFound {
+		utils.TErrorf(t, "Echo token not released: %d", res.StatusCode)
+	}
+}
+
+func TestEchoTrustedProxy(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"127.0.0.1"})
+	if err != nil {
+		utils.TFatalf(t, "Failed to parse trusted proxies: %s", err)
+	}
+	trustedProxies = proxies
+	defer func() { trustedProxies = nil }()
+	conf.BitTorrent.Timeout = timeout
+	conf.Host = "test"
+	bittorrentTracker = newMockTracker()
+	ctx := context.Background()
+	options := &websocket.DialOptions{HTTPHeader: http.Header{"X-Forwarded-For": {"198.51.100.1"}}}
+	conn, _, err := websocket.Dial(ctx, "ws://"+addr+"/v2/bittorrent", options)
+	if err != nil {
+		utils.TFatalf(t, "Cannot establish websocket connection: %s", err)
+	}
+	ws := WebsocketClient{ctx: ctx, ws: conn}
+	params := struct {
+		paramsMessage
+		Params bittorrentTestParams `json:"params"`
+	}{}
+	ws.readJson(&params, t)
+	// the client is the last address forwarded by the proxy, whose port is
+	// unknown
+	res, result := sendEcho("test", params.Params.Echo.Token, t)
+	if res.StatusCode != http.StatusOK || result.IP != "198.51.100.1" || result.Port != 0 {
+		utils.TFatalf(t, "Invalid echo result: %d %+v", res.StatusCode, result)
+	}
+	ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_BITTORRENT, IP: "198.51.100.1", Protocol: PROTOCOL_HTTP}, t)
+	done := new(doneMessage)
+	ws.readJson(done, t)
+	verdict := new(verdictMessage)
+	ws.readJson(verdict, t)
+	if verdict.ClientIP != "198.51.100.1" || verdict.Leaked || len(verdict.Addresses) != 0 {
+		utils.TErrorf(t, "Proxied client reported as a leak: %+v", verdict)
+	}
+	ws.assertEnd(conf.BitTorrent.Timeout, t)
+}
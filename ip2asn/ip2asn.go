@@ -0,0 +1,116 @@
+// Package ip2asn maps IP addresses to their autonomous system and country,
+// using the ip2asn TSV databases (https://iptoasn.com).
+package ip2asn
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Entry is a range of addresses announced by an autonomous system.
+type Entry struct {
+	Start netip.Addr
+	End   netip.Addr
+	ASN   uint32
+	// Country is an ISO 3166 alpha-2 code, empty if unknown.
+	Country     string
+	Description string
+}
+
+type DB struct {
+	// entries are sorted by start address
+	entries []Entry
+}
+
+// Load reads the database at path, which may be gzip compressed.
+func Load(path string) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return Parse(r)
+}
+
+// Parse reads a database in the ip2asn TSV format:
+// range_start, range_end, AS_number, country_code, AS_description. Ranges not
+// routed by any autonomous system are skipped.
+func Parse(r io.Reader) (*DB, error) {
+	db := new(DB)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		fields := strings.SplitN(scanner.Text(), "\t", 5)
+		if len(fields) != 5 {
+			return nil, errors.New("ip2asn: invalid line " + strconv.Itoa(line))
+		}
+		start, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, errors.New("ip2asn: invalid start address on line " + strconv.Itoa(line))
+		}
+		end, err := netip.ParseAddr(fields[1])
+		if err != nil || end.Is4() != start.Is4() || end.Less(start) {
+			return nil, errors.New("ip2asn: invalid end address on line " + strconv.Itoa(line))
+		}
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, errors.New("ip2asn: invalid AS number on line " + strconv.Itoa(line))
+		}
+		if asn == 0 {
+			continue
+		}
+		entry := Entry{Start: start, End: end, ASN: uint32(asn), Description: fields[4]}
+		if len(fields[3]) == 2 {
+			entry.Country = fields[3]
+		}
+		db.entries = append(db.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(db.entries, func(a, b Entry) int { return a.Start.Compare(b.Start) })
+	return db, nil
+}
+
+// Lookup returns the entry containing ip, if any.
+func (db *DB) Lookup(ip net.IP) (Entry, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return Entry{}, false
+	}
+	addr = addr.Unmap()
+	// index of the first entry starting after addr
+	i, _ := slices.BinarySearchFunc(db.entries, addr, func(e Entry, a netip.Addr) int {
+		if e.Start.Compare(a) <= 0 {
+			return -1
+		}
+		return 1
+	})
+	if i == 0 {
+		return Entry{}, false
+	}
+	entry := db.entries[i-1]
+	if entry.End.Less(addr) || entry.End.Is4() != addr.Is4() {
+		return Entry{}, false
+	}
+	return entry, true
+}
@@ -0,0 +1,54 @@
+package ip2asn
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"zeroleaks/utils"
+)
+
+const database = `1.0.0.0	1.0.0.255	13335	US	CLOUDFLARENET
+1.0.1.0	1.0.3.255	0	None	Not routed
+2001:db8::	2001:db8:ffff:ffff:ffff:ffff:ffff:ffff	64496	FR	EXAMPLE-V6
+192.0.2.0	192.0.2.127	64497	DE	EXAMPLE-V4
+`
+
+func TestLookup(t *testing.T) {
+	db, err := Parse(strings.NewReader(database))
+	if err != nil {
+		utils.TFatalf(t, "Failed to parse database: %s", err)
+	}
+	for _, c := range []struct {
+		ip      string
+		asn     uint32
+		country string
+	}{
+		{ip: "1.0.0.0", asn: 13335, country: "US"},
+		{ip: "1.0.0.255", asn: 13335, country: "US"},
+		{ip: "1.0.2.1"},
+		{ip: "0.255.255.255"},
+		{ip: "192.0.2.100", asn: 64497, country: "DE"},
+		{ip: "192.0.2.128"},
+		{ip: "2001:db8::1", asn: 64496, country: "FR"},
+		{ip: "2001:db9::1"},
+		{ip: "::ffff:1.0.0.1", asn: 13335, country: "US"},
+	} {
+		entry, ok := db.Lookup(net.ParseIP(c.ip))
+		if ok != (c.asn != 0) || entry.ASN != c.asn || entry.Country != c.country {
+			utils.TErrorf(t, "Invalid entry for %s: %+v %t", c.ip, entry, ok)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, line := range []string{
+		"1.0.0.0	1.0.0.255	13335	US",
+		"1.0.0.0	1.0.0.255	AS13335	US	CLOUDFLARENET",
+		"1.0.0.255	1.0.0.0	13335	US	CLOUDFLARENET",
+		"1.0.0.0	2001:db8::	13335	US	CLOUDFLARENET",
+	} {
+		if _, err := Parse(strings.NewReader(line)); err == nil {
+			utils.TErrorf(t, "Invalid line parsed: %q", line)
+		}
+	}
+}
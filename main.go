@@ -1,12 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
 	"net"
+	"net/http"
 	"time"
 	"zeroleaks/bittorrent"
+	"zeroleaks/dht"
 	"zeroleaks/dns"
+	"zeroleaks/ip2asn"
+	"zeroleaks/stun"
+	"zeroleaks/turn"
 
 	"github.com/BurntSushi/toml"
 	"github.com/coder/websocket"
@@ -17,37 +23,126 @@ type TLSConfig struct {
 	Key  string
 }
 
+// Enabled is true if the servers using the configuration serve HTTPS rather
+// than plain HTTP.
+func (c TLSConfig) Enabled() bool {
+	return c.Cert != "" || c.Key != ""
+}
+
 type Config struct {
-	Host      string
+	Host string
+	// Optional hostnames of the helper with only IPv4 or IPv6 addresses.
+	IPv4Host  string `toml:"ipv4_host"`
+	IPv6Host  string `toml:"ipv6_host"`
 	Websocket struct {
 		Addr    string
 		TLS     TLSConfig
 		Origins []string
+		// Addresses or networks of the reverse proxies in front of the
+		// websocket server, whose X-Forwarded-For headers are honoured.
+		TrustedProxies []string `toml:"trusted_proxies"`
 	}
 	DNS struct {
+		Addr       string
+		Domain     string
+		Timeout    time.Duration
+		TokenSize  int `toml:"token_size"`
+		Answer     string
+		TTL        time.Duration
+		Nameserver string
+		Addresses  []net.IP
+		DNSSEC     struct {
+			Key string
+		}
+	}
+	BitTorrent struct {
+		Addr     string
+		HTTPAddr string `toml:"http_addr"`
+		DHTAddr  string `toml:"dht_addr"`
+		PeerAddr string `toml:"peer_addr"`
+		// Public URL of the WebTorrent tracker, served by the websocket
+		// server under bittorrent.WEBTORRENT_PATH.
+		WebTorrentURL string `toml:"webtorrent_url"`
+		Timeout       time.Duration
+	}
+	STUN struct {
 		Addr    string
-		Domain  string
 		Timeout time.Duration
 	}
-	BitTorrent struct {
+	TURN struct {
+		// Address of the UDP and TCP listeners.
 		Addr    string
+		TLSAddr string `toml:"tls_addr"`
 		Timeout time.Duration
 	}
+	Verdict struct {
+		// Optional ip2asn database, from which the verdict reports the
+		// autonomous system and country of the addresses.
+		IP2ASN string `toml:"ip2asn"`
+	}
 }
 
-type IPLogger[T any] interface {
-	RegisterCallback(t T, f func(net.IP))
+// IPLogger reports the IPs of the requests received for registered keys.
+// A key can have several observers. inUse is true if the key was already
+// registered, in which case the caller is not the owner of the key.
+type IPLogger[T any, E any] interface {
+	RegisterCallback(k T, f func(E)) (id uint64, inUse bool)
+	Unregister(k T, id uint64)
+}
+
+type DNSLogger interface {
+	IPLogger[string, dns.Query]
+	RegisterDNSSECProbe(k string, bogus bool, f func(dns.Query)) (id uint64, inUse bool)
+	RegisterQnameMinimisationProbe(k string, f func(dns.Query)) (id uint64, inUse bool)
 }
 
 var conf Config
 
-var dnsServer IPLogger[uint32]
-var bittorrentTracker IPLogger[bittorrent.InfoHash]
+var dnsServer DNSLogger
+var bittorrentTracker IPLogger[bittorrent.InfoHash, bittorrent.Peer]
 var bittorrentTrackerPort int
 
+// bittorrentHTTPTrackerPort is 0 if the HTTP tracker is disabled.
+var bittorrentHTTPTrackerPort int
+
+// bittorrentDHTPort is 0 if the DHT node is disabled.
+var bittorrentDHTPort int
+
+// bittorrentPeerPort is 0 if the peer-wire server is disabled.
+var bittorrentPeerPort int
+
+type STUNLogger interface {
+	IPLogger[string, stun.Binding]
+	Password(k string) string
+}
+
+var stunServer STUNLogger
+
+// stunPort is 0 if the STUN server is disabled.
+var stunPort int
+
+type TURNLogger interface {
+	IPLogger[string, stun.Binding]
+	Credentials(k string) (username string, password string)
+}
+
+var turnServer TURNLogger
+
+// turnPort is 0 if the TURN server is disabled, and turnTLSPort if it
+// doesn't listen over TLS.
+var turnPort int
+var turnTLSPort int
+
+// helperAddresses are the public addresses of the helper, from DNS.addresses
+// or resolved from host.
+var helperAddresses []net.IP
+
 func main() {
 	configPath := flag.String("config", "config.toml", "Configuration file path. Defaults to \"config.toml\"")
 	flag.Parse()
+	conf.DNS.Answer = dns.ANSWER_NXDOMAIN
+	conf.DNS.TTL = dns.DEFAULT_TTL * time.Second
+	conf.DNS.TokenSize = dns.MIN_TOKEN_SIZE
 	if _, err := toml.DecodeFile(*configPath, &conf); err != nil {
 		log.Fatalln("Failed to parse config file:", err)
 	}
@@ -57,16 +152,161 @@ func main() {
 	} else {
 		websocketOptions.OriginPatterns = conf.Websocket.Origins
 	}
+	proxies, err := parseTrustedProxies(conf.Websocket.TrustedProxies)
+	if err != nil {
+		log.Fatalln("Invalid trusted proxy:", err)
+	}
+	trustedProxies = proxies
+	if conf.Verdict.IP2ASN != "" {
+		db, err := ip2asn.Load(conf.Verdict.IP2ASN)
+		if err != nil {
+			log.Fatalln("Failed to load ip2asn database:", err)
+		}
+		asnDB = db
+	}
 
+	if conf.DNS.TokenSize < dns.MIN_TOKEN_SIZE || conf.DNS.TokenSize > dns.MAX_TOKEN_SIZE {
+		log.Fatalf("Invalid DNS token size: %d. Must be between %d and %d", conf.DNS.TokenSize, dns.MIN_TOKEN_SIZE, dns.MAX_TOKEN_SIZE)
+	}
 	d := dns.NewServer(conf.DNS.Domain, conf.DNS.Timeout)
+	zone := dns.Zone{
+		Answer:     conf.DNS.Answer,
+		TTL:        uint32(conf.DNS.TTL.Seconds()),
+		Nameserver: conf.DNS.Nameserver,
+		Addresses:  conf.DNS.Addresses,
+	}
+	if zone.Nameserver == "" {
+		zone.Nameserver = conf.Host
+	}
+	if zone.Answer != dns.ANSWER_NXDOMAIN && zone.Answer != dns.ANSWER_ADDRESS {
+		log.Fatalln("Invalid DNS answer mode:", zone.Answer)
+	}
+	if conf.DNS.DNSSEC.Key != "" {
+		signer, err := dns.LoadSigner(conf.DNS.Domain, conf.DNS.DNSSEC.Key)
+		if err != nil {
+			log.Fatalln("Failed to load DNSSEC key:", err)
+		}
+		log.Println("DNSSEC enabled. DS record to publish in the parent zone:", signer.DS())
+		d.EnableDNSSEC(signer)
+	}
+	if len(zone.Addresses) == 0 {
+		zone.Addresses = lookupAddresses(zone)
+	}
+	d.SetZone(zone)
+	helperAddresses = zone.Addresses
 	dnsServer = d
 	go d.Start(conf.DNS.Addr)
 	t, port, err := bittorrent.NewTracker(conf.BitTorrent.Addr, conf.BitTorrent.Timeout)
 	if err != nil {
 		log.Fatalln("Failed to start BitTorrent tracker:", err)
 	}
-	go t.Start()
+	t.SetClientAddr(clientAddr)
 	bittorrentTracker = t
 	bittorrentTrackerPort = port
+	if conf.BitTorrent.DHTAddr != "" {
+		node, port, err := dht.NewNode(conf.BitTorrent.DHTAddr, t.Notify)
+		if err != nil {
+			log.Fatalln("Failed to start DHT node:", err)
+		}
+		go node.Start()
+		bittorrentDHTPort = port
+		t.SetDHTPort(port)
+	}
+	if conf.BitTorrent.PeerAddr != "" {
+		l, err := net.Listen("tcp", conf.BitTorrent.PeerAddr)
+		if err != nil {
+			log.Fatalln("Failed to start BitTorrent peer-wire server:", err)
+		}
+		bittorrentPeerPort = l.Addr().(*net.TCPAddr).Port
+		t.SetPeers(zone.Addresses, bittorrentPeerPort)
+		go t.ServePeerWire(l)
+	}
+	// the tracker is fully configured before serving any client
+	if conf.BitTorrent.HTTPAddr != "" {
+		l, err := net.Listen("tcp", conf.BitTorrent.HTTPAddr)
+		if err != nil {
+			log.Fatalln("Failed to start BitTorrent HTTP tracker:", err)
+		}
+		bittorrentHTTPTrackerPort = l.Addr().(*net.TCPAddr).Port
+		go startHTTPTracker(l, t, conf.Websocket.TLS)
+	}
+	if conf.BitTorrent.WebTorrentURL != "" {
+		http.HandleFunc(bittorrent.WEBTORRENT_PATH, t.ServeWebTorrent)
+	}
+	go t.Start()
+	if conf.STUN.Addr != "" {
+		s, port, err := stun.NewServer(conf.STUN.Addr, conf.STUN.Timeout)
+		if err != nil {
+			log.Fatalln("Failed to start STUN server:", err)
+		}
+		stunServer = s
+		stunPort = port
+		go s.Start()
+	}
+	if conf.TURN.Addr != "" {
+		startTURNServer()
+	}
 	startWebsocketServer(conf.Websocket.Addr, conf.Websocket.TLS, websocketOptions)
 }
+
+// lookupAddresses resolves the addresses of the helper from its host, if a
+// feature needs them. It fails if the DNS server can't work without them, and
+// logs a warning if only optional features are degraded.
+func lookupAddresses(zone dns.Zone) []net.IP {
+	required := zone.NeedsAddresses(conf.DNS.Domain) || conf.DNS.DNSSEC.Key != ""
+	optional := conf.BitTorrent.PeerAddr != "" || conf.STUN.Addr != "" || conf.TURN.Addr != ""
+	if !required && !optional {
+		return nil
+	}
+	addresses, err := net.LookupIP(conf.Host)
+	if err != nil && required {
+		log.Fatalln("Failed to resolve host:", err)
+	}
+	if err != nil {
+		log.Println("Warning: failed to resolve host, the helper won't be advertised as a BitTorrent peer, WebRTC candidate or TURN relay:", err)
+	}
+	return addresses
+}
+
+// startHTTPTracker serves the HTTP tracker on l, over TLS if the websocket
+// server uses TLS.
+func startHTTPTracker(l net.Listener, t *bittorrent.Tracker, tls TLSConfig) {
+	var err error
+	if !tls.Enabled() {
+		err = http.Serve(l, t)
+	} else {
+		err = http.ServeTLS(l, t, tls.Cert, tls.Key)
+	}
+	log.Fatalln("BitTorrent HTTP tracker stopped:", err)
+}
+
+// startTURNServer listens on UDP and TCP, and over TLS with the certificate
+// of the websocket server if TURN.tls_addr is set.
+func startTURNServer() {
+	s := turn.NewServer(conf.TURN.Timeout, helperAddresses)
+	conn, err := net.ListenPacket("udp", conf.TURN.Addr)
+	if err != nil {
+		log.Fatalln("Failed to start TURN server:", err)
+	}
+	l, err := net.Listen("tcp", conf.TURN.Addr)
+	if err != nil {
+		log.Fatalln("Failed to start TURN server:", err)
+	}
+	turnServer = s
+	turnPort = conn.LocalAddr().(*net.UDPAddr).Port
+	go s.ServeUDP(conn)
+	go s.ServeTCP(l, turn.TRANSPORT_TCP)
+	if conf.TURN.TLSAddr == "" {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(conf.Websocket.TLS.Cert, conf.Websocket.TLS.Key)
+	if err != nil {
+		log.Fatalln("Failed to load TLS certificate of the TURN server:", err)
+	}
+	l, err = tls.Listen("tcp", conf.TURN.TLSAddr, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		log.Fatalln("Failed to start TURN server over TLS:", err)
+	}
+	turnTLSPort = l.Addr().(*net.TCPAddr).Port
+	go s.ServeTCP(l, turn.TRANSPORT_TLS)
+}
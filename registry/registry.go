@@ -0,0 +1,84 @@
+package registry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+type entry[E any, D any] struct {
+	data      D
+	observers map[uint64]func(E)
+}
+
+// Registry maps keys to the callbacks observing the events received for
+// them. Each key holds data D, set by its first registration. Keys expire
+// after the registry timeout, or as soon as they have no observers left.
+type Registry[K comparable, E any, D any] struct {
+	mutex   sync.Mutex
+	entries *ttlcache.Cache[K, *entry[E, D]]
+	nextID  uint64
+}
+
+func New[K comparable, E any, D any](timeout time.Duration) *Registry[K, E, D] {
+	r := Registry[K, E, D]{
+		entries: ttlcache.New(
+			ttlcache.WithTTL[K, *entry[E, D]](timeout),
+			ttlcache.WithDisableTouchOnHit[K, *entry[E, D]](),
+		),
+	}
+	go r.entries.Start()
+	return &r
+}
+
+// Register adds f to the observers of k and returns its id. If k is already
+// registered, inUse is true and data is ignored.
+func (r *Registry[K, E, D]) Register(k K, data D, f func(E)) (id uint64, inUse bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.nextID++
+	item, inUse := r.entries.GetOrSet(k, &entry[E, D]{
+		data:      data,
+		observers: make(map[uint64]func(E)),
+	})
+	item.Value().observers[r.nextID] = f
+	return r.nextID, inUse
+}
+
+// Unregister removes the observer id of k.
+func (r *Registry[K, E, D]) Unregister(k K, id uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if item := r.entries.Get(k); item != nil {
+		delete(item.Value().observers, id)
+		if len(item.Value().observers) == 0 {
+			r.entries.Delete(k)
+		}
+	}
+}
+
+func (r *Registry[K, E, D]) Has(k K) bool {
+	return r.entries.Has(k)
+}
+
+// Notify calls all the observers of k with e. found is false if k is not
+// registered.
+func (r *Registry[K, E, D]) Notify(k K, e E) (data D, found bool) {
+	r.mutex.Lock()
+	item := r.entries.Get(k)
+	if item == nil {
+		r.mutex.Unlock()
+		return data, false
+	}
+	observers := make([]func(E), 0, len(item.Value().observers))
+	for _, f := range item.Value().observers {
+		observers = append(observers, f)
+	}
+	data = item.Value().data
+	r.mutex.Unlock()
+	for _, f := range observers {
+		f(e)
+	}
+	return data, true
+}
@@ -0,0 +1,59 @@
+package registry
+
+import (
+	"testing"
+	"time"
+	"zeroleaks/utils"
+)
+
+const timeout = 100 * time.Millisecond
+
+func TestObservers(t *testing.T) {
+	r := New[string, int, string](timeout)
+	if _, found := r.Notify("key", 0); found {
+		utils.TErrorf(t, "Unregistered key found")
+	}
+	var first, second []int
+	id1, inUse := r.Register("key", "data", func(e int) {
+		first = append(first, e)
+	})
+	if inUse {
+		utils.TErrorf(t, "New key reported in use")
+	}
+	id2, inUse := r.Register("key", "ignored", func(e int) {
+		second = append(second, e)
+	})
+	if !inUse {
+		utils.TErrorf(t, "Registered key not reported in use")
+	}
+	if id1 == id2 {
+		utils.TErrorf(t, "Observers have the same id: %d", id1)
+	}
+	data, found := r.Notify("key", 1)
+	if !found || data != "data" {
+		utils.TErrorf(t, "Invalid notification result: %q %t", data, found)
+	}
+	r.Unregister("key", id1)
+	r.Notify("key", 2)
+	if len(first) != 1 || len(second) != 2 {
+		utils.TErrorf(t, "Invalid events received: %v and %v", first, second)
+	}
+	r.Unregister("key", id2)
+	if r.Has("key") {
+		utils.TErrorf(t, "Key still registered without observers")
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	r := New[string, int, struct{}](timeout)
+	r.Register("key", struct{}{}, func(e int) {
+		utils.TErrorf(t, "Callback unexpectedly called with %d", e)
+	})
+	time.Sleep(timeout + 20*time.Millisecond)
+	if _, found := r.Notify("key", 0); found {
+		utils.TErrorf(t, "Key not expired after %s", timeout)
+	}
+	if _, inUse := r.Register("key", struct{}{}, func(int) {}); inUse {
+		utils.TErrorf(t, "Expired key reported in use")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+const TEST_SESSION = "session"
+
+// the client must send its session request within this duration
+const SESSION_REQUEST_TIMEOUT = 10 * time.Second
+
+const (
+	ERROR_INVALID_REQUEST = "invalid_request"
+	ERROR_UNKNOWN_TEST    = "unknown_test"
+)
+
+// sessionRequest is the first message sent by the client of a session.
+type sessionRequest struct {
+	Tests []string `json:"tests"`
+}
+
+// sessionTest runs the tests requested by the client over a single
+// connection. The params message holds the parameters of each test, by
+// test. Leaks are tagged with their test, and the session ends with the
+// done message of each test followed by a verdict. Sessions are only
+// available with the v2 protocol.
+func sessionTest(ws *websocket.Conn, r *http.Request, version int) {
+	var request sessionRequest
+	ctx, cancel := context.WithTimeout(context.Background(), SESSION_REQUEST_TIMEOUT)
+	err := wsjson.Read(ctx, ws, &request)
+	cancel()
+	ctx = ws.CloseRead(context.Background())
+	if err != nil || len(request.Tests) == 0 {
+		closeWithError(ctx, ws, version, ERROR_INVALID_REQUEST, "invalid session request")
+		return
+	}
+	var timeout time.Duration
+	for i, test := range request.Tests {
+		if slices.Contains(request.Tests[:i], test) {
+			closeWithError(ctx, ws, version, ERROR_INVALID_REQUEST, "duplicate test: "+test)
+			return
+		}
+		switch test {
+		case TEST_DNS:
+			timeout = max(timeout, conf.DNS.Timeout)
+		case TEST_BITTORRENT:
+			timeout = max(timeout, conf.BitTorrent.Timeout)
+		case TEST_WEBRTC:
+			if stunPort == 0 {
+				closeWithError(ctx, ws, version, ERROR_WEBRTC_DISABLED, "STUN server is not enabled")
+				return
+			}
+			timeout = max(timeout, conf.STUN.Timeout)
+		default:
+			closeWithError(ctx, ws, version, ERROR_UNKNOWN_TEST, "unknown test: "+test)
+			return
+		}
+	}
+	ipSender := NewIPSender(ws, ctx, TEST_SESSION, version, timeout)
+	ipSender.ClientIP = clientIP(r)
+	params := make(map[string]any, len(request.Tests))
+	for _, test := range request.Tests {
+		sub := ipSender.Sub(test)
+		switch test {
+		case TEST_DNS:
+			params[test] = setupDNSLeakTest(sub)
+		case TEST_BITTORRENT:
+			params[test] = setupBittorrentLeakTest(sub)
+		case TEST_WEBRTC:
+			params[test] = setupWebrtcLeakTest(sub)
+		}
+	}
+	if err := ipSender.WriteParams(params); err != nil {
+		return
+	}
+	go ipSender.Start()
+}
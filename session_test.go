@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"testing"
+	"zeroleaks/bittorrent"
+	"zeroleaks/dns"
+	"zeroleaks/utils"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func sessionConnect(tests []string, t *testing.T) WebsocketClient {
+	ws := wsConnectVersion(PROTOCOL_V2, TEST_SESSION, t)
+	if err := wsjson.Write(context.Background(), ws.ws, sessionRequest{Tests: tests}); err != nil {
+		utils.TFatalf(t, "Failed to send session request: %s", err)
+	}
+	return ws
+}
+
+func TestSession(t *testing.T) {
+	conf.DNS.Domain = "test"
+	conf.DNS.Timeout = timeout
+	conf.BitTorrent.Timeout = timeout / 2
+	conf.Host = "test"
+	dnsLogger := newMockDNSLogger()
+	dnsServer = dnsLogger
+	tracker := newMockTracker()
+	bittorrentTracker = tracker
+	ws := sessionConnect([]string{TEST_DNS, TEST_BITTORRENT}, t)
+	params := struct {
+		paramsMessage
+		Params struct {
+			DNS        dnsLeakTestParams    `json:"dns"`
+			BitTorrent bittorrentTestParams `json:"bittorrent"`
+		} `json:"params"`
+	}{}
+	ws.readJson(&params, t)
+	if params.Type != MESSAGE_PARAMS || params.Test != TEST_SESSION {
+		utils.TErrorf(t, "Invalid params message: %s/%s", params.Type, params.Test)
+	}
+	subdomain := params.Params.DNS.Subdomains[0]
+	query, ok := dnsLogger.callback(subdomain)
+	if !ok {
+		utils.TFatalf(t, "Subdomain %s not registered", subdomain)
+	}
+	infoHash, err := hex.DecodeString(params.Params.BitTorrent.InfoHash)
+	if err != nil {
+		utils.TFatalf(t, "Failed to decode info hash %s: %s", params.Params.BitTorrent.InfoHash, err)
+	}
+	peer, ok := tracker.callback(bittorrent.InfoHash(infoHash))
+	if !ok {
+		utils.TFatalf(t, "Info hash %s not registered", params.Params.BitTorrent.InfoHash)
+	}
+	resolver := net.IPv4(198, 51, 100, 1)
+	go func() {
+		query(dns.Query{IP: resolver, Port: 1234, Transport: dns.TRANSPORT_UDP, Subdomain: subdomain, Type: 1})
+		// the client itself, as seen by the websocket server
+		peer(bittorrent.Peer{IP: []byte{127, 0, 0, 1}, Port: 6881, Protocol: bittorrent.PROTOCOL_UDP, Request: bittorrent.REQUEST_ANNOUNCE})
+		peer(bittorrent.Peer{IP: resolver, Port: 6881, Protocol: bittorrent.PROTOCOL_UDP, Request: bittorrent.REQUEST_ANNOUNCE})
+	}()
+	ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_DNS, IP: resolver.String(), Port: 1234, Protocol: dns.TRANSPORT_UDP, Subdomain: subdomain}, t)
+	ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_BITTORRENT, IP: "127.0.0.1", Port: 6881, Protocol: bittorrent.PROTOCOL_UDP, InfoHash: params.Params.BitTorrent.InfoHash}, t)
+	ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_BITTORRENT, IP: resolver.String(), Port: 6881, Protocol: bittorrent.PROTOCOL_UDP, InfoHash: params.Params.BitTorrent.InfoHash}, t)
+
+	dnsDone := struct {
+		doneMessage
+		Summary dnsSummary `json:"summary"`
+	}{}
+	ws.readJson(&dnsDone, t)
+	if dnsDone.Test != TEST_DNS || dnsDone.Leaks != 1 || dnsDone.Summary.Resolver.Queries != 1 {
+		utils.TErrorf(t, "Invalid DNS done message: %+v", dnsDone)
+	}
+	bittorrentDone := new(doneMessage)
+	ws.readJson(bittorrentDone, t)
+	if bittorrentDone.Test != TEST_BITTORRENT || bittorrentDone.Leaks != 2 || len(bittorrentDone.IPs) != 2 {
+		utils.TErrorf(t, "Invalid BitTorrent done message: %+v", bittorrentDone)
+	}
+	verdict := new(verdictMessage)
+	ws.readJson(verdict, t)
+	if verdict.Type != MESSAGE_VERDICT || verdict.ClientIP != "127.0.0.1" || !verdict.Leaked {
+		utils.TErrorf(t, "Invalid verdict: %+v", verdict)
+	}
+	if len(verdict.Addresses) != 1 {
+		utils.TFatalf(t, "Invalid verdict addresses: %+v", verdict.Addresses)
+	}
+	if address := verdict.Addresses[0]; address.IP != resolver.String() || len(address.Tests) != 2 || address.Tests[0] != TEST_DNS || address.Tests[1] != TEST_BITTORRENT || !address.Leak {
+		utils.TErrorf(t, "Invalid verdict address: %+v", address)
+	}
+	ws.assertEnd(timeout, t)
+	if dnsLogger.len() != 0 || tracker.len() != 0 {
+		utils.TErrorf(t, "Session tokens not unregistered")
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	for _, c := range []struct {
+		tests []string
+		code  string
+	}{
+		{tests: nil, code: ERROR_INVALID_REQUEST},
+		{tests: []string{TEST_DNS, TEST_DNS}, code: ERROR_INVALID_REQUEST},
+		{tests: []string{TEST_DNS, TEST_DNSSEC}, code: ERROR_UNKNOWN_TEST},
+		{tests: []string{TEST_WEBRTC}, code: ERROR_WEBRTC_DISABLED},
+	} {
+		ws := sessionConnect(c.tests, t)
+		msg := new(errorMessage)
+		ws.readJson(msg, t)
+		if msg.Type != MESSAGE_ERROR || msg.Code != c.code {
+			utils.TErrorf(t, "Invalid error message for %v: %+v", c.tests, msg)
+		}
+		if _, _, err := ws.ws.Read(ws.ctx); websocket.CloseStatus(err) != websocket.StatusInternalError {
+			utils.TErrorf(t, "Invalid close status: %s", err)
+		}
+	}
+}
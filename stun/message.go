@@ -0,0 +1,217 @@
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+const (
+	HEADER_SIZE         = 20
+	MAGIC_COOKIE        = 0x2112A442
+	TRANSACTION_ID_SIZE = 12
+
+	// message classes, combined with a method to form a message type
+	CLASS_REQUEST    = 0x0000
+	CLASS_INDICATION = 0x0010
+	CLASS_SUCCESS    = 0x0100
+	CLASS_ERROR      = 0x0110
+	CLASS_MASK       = 0x0110
+
+	METHOD_BINDING = 0x0001
+
+	ATTR_USERNAME           = 0x0006
+	ATTR_MESSAGE_INTEGRITY  = 0x0008
+	ATTR_ERROR_CODE         = 0x0009
+	ATTR_XOR_MAPPED_ADDRESS = 0x0020
+	ATTR_SOFTWARE           = 0x8022
+	ATTR_FINGERPRINT        = 0x8028
+
+	MESSAGE_INTEGRITY_SIZE = 20
+	FINGERPRINT_SIZE       = 4
+	FINGERPRINT_XOR        = 0x5354554e
+
+	FAMILY_IPV4 = 1
+	FAMILY_IPV6 = 2
+
+	ERROR_BAD_REQUEST  = 400
+	ERROR_UNAUTHORIZED = 401
+)
+
+var ErrInvalidMessage = errors.New("invalid STUN message")
+
+type Attribute struct {
+	Type  uint16
+	Value []byte
+}
+
+// Message is a STUN message (RFC 8489).
+type Message struct {
+	Type          uint16
+	TransactionId [TRANSACTION_ID_SIZE]byte
+	Attributes    []Attribute
+	// raw is the message as received and integrityOffset the offset of its
+	// MESSAGE-INTEGRITY attribute, if any, which covers everything before.
+	raw             []byte
+	integrityOffset int
+}
+
+// Parse decodes the STUN message at the beginning of b.
+func Parse(b []byte) (*Message, error) {
+	if len(b) < HEADER_SIZE || b[0]&0xc0 != 0 || binary.BigEndian.Uint32(b[4:8]) != MAGIC_COOKIE {
+		return nil, ErrInvalidMessage
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length%4 != 0 || HEADER_SIZE+length > len(b) {
+		return nil, ErrInvalidMessage
+	}
+	m := Message{Type: binary.BigEndian.Uint16(b[0:2]), raw: b[:HEADER_SIZE+length]}
+	copy(m.TransactionId[:], b[8:HEADER_SIZE])
+	for offset := HEADER_SIZE; offset < len(m.raw); {
+		if offset+4 > len(m.raw) {
+			return nil, ErrInvalidMessage
+		}
+		t := binary.BigEndian.Uint16(m.raw[offset:])
+		size := int(binary.BigEndian.Uint16(m.raw[offset+2:]))
+		if offset+4+size > len(m.raw) {
+			return nil, ErrInvalidMessage
+		}
+		// attributes following MESSAGE-INTEGRITY, other than FINGERPRINT,
+		// must be ignored
+		if m.integrityOffset == 0 || t == ATTR_FINGERPRINT {
+			m.Attributes = append(m.Attributes, Attribute{Type: t, Value: m.raw[offset+4 : offset+4+size]})
+		}
+		if t == ATTR_MESSAGE_INTEGRITY && m.integrityOffset == 0 {
+			m.integrityOffset = offset
+		}
+		offset += 4 + (size+3)&^3
+	}
+	return &m, nil
+}
+
+// Method returns the method of the message, without its class.
+func (m *Message) Method() uint16 {
+	return m.Type &^ CLASS_MASK
+}
+
+func (m *Message) Class() uint16 {
+	return m.Type & CLASS_MASK
+}
+
+// Get returns the value of the first attribute of type t.
+func (m *Message) Get(t uint16) ([]byte, bool) {
+	for _, a := range m.Attributes {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (m *Message) Add(t uint16, value []byte) {
+	m.Attributes = append(m.Attributes, Attribute{Type: t, Value: value})
+}
+
+// AddXorAddress adds an attribute of type t encoding ip and port XORed with
+// the magic cookie and the transaction ID, such as XOR-MAPPED-ADDRESS.
+func (m *Message) AddXorAddress(t uint16, ip net.IP, port int) {
+	value := []byte{0, FAMILY_IPV4}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		value[1] = FAMILY_IPV6
+		ip = ip.To16()
+	}
+	value = binary.BigEndian.AppendUint16(value, uint16(port)^uint16(MAGIC_COOKIE>>16))
+	m.Add(t, append(value, m.xor(ip)...))
+}
+
+// XorAddress decodes the first attribute of type t added by AddXorAddress.
+func (m *Message) XorAddress(t uint16) (net.IP, int, bool) {
+	value, ok := m.Get(t)
+	if !ok || len(value) < 4 {
+		return nil, 0, false
+	}
+	port := int(binary.BigEndian.Uint16(value[2:4]) ^ uint16(MAGIC_COOKIE>>16))
+	switch {
+	case value[1] == FAMILY_IPV4 && len(value) == 4+net.IPv4len:
+	case value[1] == FAMILY_IPV6 && len(value) == 4+net.IPv6len:
+	default:
+		return nil, 0, false
+	}
+	return net.IP(m.xor(value[4:])), port, true
+}
+
+// xor XORs the address b with the magic cookie followed by the transaction
+// ID.
+func (m *Message) xor(b []byte) []byte {
+	key := binary.BigEndian.AppendUint32(nil, MAGIC_COOKIE)
+	key = append(key, m.TransactionId[:]...)
+	result := make([]byte, len(b))
+	for i := range b {
+		result[i] = b[i] ^ key[i]
+	}
+	return result
+}
+
+func (m *Message) AddError(code int, reason string) {
+	value := []byte{0, 0, byte(code / 100), byte(code % 100)}
+	m.Add(ATTR_ERROR_CODE, append(value, reason...))
+}
+
+// Response returns a message of the given class answering m.
+func (m *Message) Response(class uint16) *Message {
+	return &Message{Type: m.Method() | class, TransactionId: m.TransactionId}
+}
+
+// CheckIntegrity tells whether m has a MESSAGE-INTEGRITY attribute computed
+// with key.
+func (m *Message) CheckIntegrity(key []byte) bool {
+	if m.integrityOffset == 0 {
+		return false
+	}
+	value, _ := m.Get(ATTR_MESSAGE_INTEGRITY)
+	buff := append([]byte(nil), m.raw[:m.integrityOffset]...)
+	binary.BigEndian.PutUint16(buff[2:4], uint16(m.integrityOffset-HEADER_SIZE+4+MESSAGE_INTEGRITY_SIZE))
+	return hmac.Equal(value, integrity(buff, key))
+}
+
+func integrity(b []byte, key []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+// Encode returns the wire format of m. If key is not nil, a
+// MESSAGE-INTEGRITY attribute is computed with it. A FINGERPRINT attribute
+// is always added.
+func (m *Message) Encode(key []byte) []byte {
+	buff := binary.BigEndian.AppendUint16(nil, m.Type)
+	buff = append(buff, 0, 0)
+	buff = binary.BigEndian.AppendUint32(buff, MAGIC_COOKIE)
+	buff = append(buff, m.TransactionId[:]...)
+	for _, a := range m.Attributes {
+		buff = appendAttribute(buff, a.Type, a.Value)
+	}
+	if key != nil {
+		binary.BigEndian.PutUint16(buff[2:4], uint16(len(buff)-HEADER_SIZE+4+MESSAGE_INTEGRITY_SIZE))
+		buff = appendAttribute(buff, ATTR_MESSAGE_INTEGRITY, integrity(buff, key))
+	}
+	binary.BigEndian.PutUint16(buff[2:4], uint16(len(buff)-HEADER_SIZE+4+FINGERPRINT_SIZE))
+	fingerprint := crc32.ChecksumIEEE(buff) ^ FINGERPRINT_XOR
+	return appendAttribute(buff, ATTR_FINGERPRINT, binary.BigEndian.AppendUint32(nil, fingerprint))
+}
+
+// appendAttribute appends an attribute to b, padded to a multiple of 4 bytes.
+func appendAttribute(b []byte, t uint16, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, t)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,91 @@
+package stun
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"zeroleaks/utils"
+)
+
+// test vectors of RFC 5769
+const sampleRequest = "000100582112a442b7e7a701bc34d686fa87dfae802200105354554e207465737420636c69656e74" +
+	"002400046e0001ff80290008932ff9b151263b36000600096576746a3a68367659202020" +
+	"000800149aeaa70cbfd8cb56781ef2b5b2d3f249c1b571a280280004e57a3bcf"
+const sampleResponse = "0101003c2112a442b7e7a701bc34d686fa87dfae8022000b7465737420766563746f7220" +
+	"002000080001a147e112a643000800142b91f599fd9e90c38c7489f92af9ba53f06be7d7" +
+	"80280004c07d4c96"
+const samplePassword = "VOkJxbRl1RmTxUk/WvJxBt"
+
+func decodeHex(s string, t *testing.T) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		utils.TFatalf(t, "Invalid hex string: %s", err)
+	}
+	return b
+}
+
+func TestParse(t *testing.T) {
+	request, err := Parse(decodeHex(sampleRequest, t))
+	if err != nil {
+		utils.TFatalf(t, "Failed to parse sample request: %s", err)
+	}
+	if request.Class() != CLASS_REQUEST || request.Method() != METHOD_BINDING {
+		utils.TErrorf(t, "Invalid message type: %04x", request.Type)
+	}
+	if username, _ := request.Get(ATTR_USERNAME); string(username) != "evtj:h6vY" {
+		utils.TErrorf(t, "Invalid username: %q", username)
+	}
+	if !request.CheckIntegrity([]byte(samplePassword)) {
+		utils.TErrorf(t, "Invalid integrity of sample request")
+	}
+	if request.CheckIntegrity([]byte("wrong password")) {
+		utils.TErrorf(t, "Integrity checked with a wrong password")
+	}
+
+	response, err := Parse(decodeHex(sampleResponse, t))
+	if err != nil {
+		utils.TFatalf(t, "Failed to parse sample response: %s", err)
+	}
+	ip, port, ok := response.XorAddress(ATTR_XOR_MAPPED_ADDRESS)
+	if !ok || !ip.Equal(net.IPv4(192, 0, 2, 1)) || port != 32853 {
+		utils.TErrorf(t, "Invalid mapped address: %s %d", ip, port)
+	}
+	if !response.CheckIntegrity([]byte(samplePassword)) {
+		utils.TErrorf(t, "Invalid integrity of sample response")
+	}
+
+	for _, invalid := range []string{"", "0001000021", strings.Replace(sampleRequest, "2112a442", "2112a443", 1), sampleRequest[:len(sampleRequest)-8]} {
+		if _, err := Parse(decodeHex(invalid, t)); err == nil {
+			utils.TErrorf(t, "Invalid message parsed: %s", invalid)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	request, _ := Parse(decodeHex(sampleRequest, t))
+	for _, ip := range []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677")} {
+		response := request.Response(CLASS_SUCCESS)
+		response.AddXorAddress(ATTR_XOR_MAPPED_ADDRESS, ip, 32853)
+		response.Add(ATTR_SOFTWARE, []byte("test vector"))
+		decoded, err := Parse(response.Encode([]byte(samplePassword)))
+		if err != nil {
+			utils.TFatalf(t, "Failed to parse encoded message: %s", err)
+		}
+		if decoded.Type != METHOD_BINDING|CLASS_SUCCESS || decoded.TransactionId != request.TransactionId {
+			utils.TErrorf(t, "Invalid header: %04x %x", decoded.Type, decoded.TransactionId)
+		}
+		if mapped, port, _ := decoded.XorAddress(ATTR_XOR_MAPPED_ADDRESS); !mapped.Equal(ip) || port != 32853 {
+			utils.TErrorf(t, "Invalid mapped address: got %s %d, expected %s", mapped, port, ip)
+		}
+		if software, _ := decoded.Get(ATTR_SOFTWARE); string(software) != "test vector" {
+			utils.TErrorf(t, "Invalid software: %q", software)
+		}
+		if !decoded.CheckIntegrity([]byte(samplePassword)) {
+			utils.TErrorf(t, "Invalid integrity of encoded message")
+		}
+		if _, ok := decoded.Get(ATTR_FINGERPRINT); !ok {
+			utils.TErrorf(t, "Missing fingerprint")
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Package stun implements a STUN server (RFC 8489) answering Binding
+// requests. Requests carrying the USERNAME of a registered session, such as
+// the ICE connectivity checks (RFC 8445) of a browser given the session token
+// as remote ufrag, are reported along with their reflexive address.
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"zeroleaks/registry"
+	"zeroleaks/utils"
+)
+
+const (
+	STUN_LOG_TAG = "STUN server:"
+
+	MAX_PACKET_SIZE = 1500
+	SOFTWARE        = "ZeroLeaks"
+	// Size in bytes of the passwords, hex encoded into 32 characters. ICE
+	// requires at least 22.
+	PASSWORD_SIZE = 16
+
+	TRANSPORT_UDP = "udp"
+)
+
+// Binding is a Binding request received for a registered session.
+type Binding struct {
+	IP        net.IP
+	Port      int
+	Transport string
+	// Username is the USERNAME attribute of the request. For ICE
+	// connectivity checks, it is the session token followed by a colon and
+	// the ufrag of the browser.
+	Username string
+	Software string
+	// Relay is true for the requests of TURN clients.
+	Relay bool
+}
+
+type Server struct {
+	conn net.PacketConn
+	// secret derives the passwords of the sessions from their token.
+	secret   []byte
+	sessions *registry.Registry[string, Binding, struct{}]
+}
+
+func NewServer(addr string, timeout time.Duration) (*Server, int, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, -1, err
+	}
+	server := Server{
+		conn:     conn,
+		secret:   utils.RandomBytes(32),
+		sessions: registry.New[string, Binding, struct{}](timeout),
+	}
+	return &server, conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// RegisterCallback adds f to the observers of the session token k. inUse is
+// true if k was already registered.
+func (s *Server) RegisterCallback(k string, f func(Binding)) (id uint64, inUse bool) {
+	return s.sessions.Register(k, struct{}{}, f)
+}
+
+func (s *Server) Unregister(k string, id uint64) {
+	s.sessions.Unregister(k, id)
+}
+
+// Password returns the password of the session token k, with which the
+// requests of the session and their responses are authenticated
+// (MESSAGE-INTEGRITY with short-term credentials).
+func (s *Server) Password(k string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(k))
+	return hex.EncodeToString(mac.Sum(nil)[:PASSWORD_SIZE])
+}
+
+// handle returns the response to the request in packet, or nil if it must
+// not be answered.
+func (s *Server) handle(src net.IP, port int, transport string, packet []byte) []byte {
+	request, err := Parse(packet)
+	if err != nil {
+		log.Printf("%s Error: invalid message received from %s: %s", STUN_LOG_TAG, net.JoinHostPort(src.String(), strconv.Itoa(port)), err)
+		return nil
+	}
+	if request.Class() != CLASS_REQUEST {
+		// indications, such as ICE keepalives, are not answered
+		return nil
+	}
+	if request.Method() != METHOD_BINDING {
+		response := request.Response(CLASS_ERROR)
+		response.AddError(ERROR_BAD_REQUEST, "Unsupported method")
+		return response.Encode(nil)
+	}
+	var key []byte
+	if username, ok := request.Get(ATTR_USERNAME); ok {
+		token, _, _ := strings.Cut(string(username), ":")
+		key = []byte(s.Password(token))
+		_, hasIntegrity := request.Get(ATTR_MESSAGE_INTEGRITY)
+		if !s.sessions.Has(token) || (hasIntegrity && !request.CheckIntegrity(key)) {
+			response := request.Response(CLASS_ERROR)
+			response.AddError(ERROR_UNAUTHORIZED, "Unauthorized")
+			return response.Encode(nil)
+		}
+		binding := Binding{IP: src, Port: port, Transport: transport, Username: string(username)}
+		if software, ok := request.Get(ATTR_SOFTWARE); ok {
+			binding.Software = string(software)
+		}
+		s.sessions.Notify(token, binding)
+		if !hasIntegrity {
+			key = nil
+		}
+	}
+	// requests without USERNAME are answered like any public STUN server
+	response := request.Response(CLASS_SUCCESS)
+	response.AddXorAddress(ATTR_XOR_MAPPED_ADDRESS, src, port)
+	response.Add(ATTR_SOFTWARE, []byte(SOFTWARE))
+	return response.Encode(key)
+}
+
+func (s *Server) Start() {
+	buff := make([]byte, MAX_PACKET_SIZE)
+	for {
+		n, src, err := s.conn.ReadFrom(buff)
+		if err != nil {
+			log.Printf("%s Error while reading UDP packet from %s: %s", STUN_LOG_TAG, src, err)
+			continue
+		}
+		udpAddr := src.(*net.UDPAddr)
+		if response := s.handle(udpAddr.IP, udpAddr.Port, TRANSPORT_UDP, buff[:n]); response != nil {
+			if _, err := s.conn.WriteTo(response, src); err != nil {
+				log.Printf("%s Error while sending UDP packet to %s: %s", STUN_LOG_TAG, src, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package stun
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+	"zeroleaks/utils"
+)
+
+const timeout = time.Millisecond * 100
+
+var server *Server
+var addr string
+
+func TestMain(m *testing.M) {
+	s, port, err := NewServer("127.0.0.1:0", timeout)
+	if err != nil {
+		panic(err)
+	}
+	server = s
+	addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	go server.Start()
+	os.Exit(m.Run())
+}
+
+// exchange sends request to the server and returns its response.
+func exchange(request []byte, t *testing.T) (*Message, *net.UDPAddr) {
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		utils.TFatalf(t, "Failed to connect to the STUN server: %s", err)
+	}
+	defer c.Close()
+	if _, err := c.Write(request); err != nil {
+		utils.TFatalf(t, "Failed to send request: %s", err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	buff := make([]byte, MAX_PACKET_SIZE)
+	n, err := c.Read(buff)
+	if err != nil {
+		utils.TFatalf(t, "Failed to read response: %s", err)
+	}
+	response, err := Parse(buff[:n])
+	if err != nil {
+		utils.TFatalf(t, "Failed to parse response: %s", err)
+	}
+	return response, c.LocalAddr().(*net.UDPAddr)
+}
+
+func bindingRequest(username string) *Message {
+	request := &Message{Type: METHOD_BINDING | CLASS_REQUEST}
+	copy(request.TransactionId[:], utils.RandomBytes(TRANSACTION_ID_SIZE))
+	if username != "" {
+		request.Add(ATTR_USERNAME, []byte(username))
+	}
+	return request
+}
+
+func assertMappedAddress(response *Message, expected *net.UDPAddr, t *testing.T) {
+	if response.Type != METHOD_BINDING|CLASS_SUCCESS {
+		utils.TFatalf(t, "Invalid response type: %04x", response.Type)
+	}
+	ip, port, ok := response.XorAddress(ATTR_XOR_MAPPED_ADDRESS)
+	if !ok || !ip.Equal(expected.IP) || port != expected.Port {
+		utils.TErrorf(t, "Invalid mapped address: got %s %d, expected %s", ip, port, expected)
+	}
+}
+
+func TestBinding(t *testing.T) {
+	token := "0123456789abcdef"
+	bindings := new(utils.Recorder[Binding])
+	id, _ := server.RegisterCallback(token, bindings.Add)
+	defer server.Unregister(token, id)
+	password := []byte(server.Password(token))
+	if len(password) < 22 {
+		utils.TErrorf(t, "Password too short for ICE: %q", password)
+	}
+
+	// ICE connectivity check
+	request := bindingRequest(token + ":h6vY")
+	request.Add(ATTR_SOFTWARE, []byte("libwebrtc"))
+	response, local := exchange(request.Encode(password), t)
+	assertMappedAddress(response, local, t)
+	if !response.CheckIntegrity(password) {
+		utils.TErrorf(t, "Invalid integrity of the response")
+	}
+	if len(bindings.Get()) != 1 {
+		utils.TFatalf(t, "Callback called %d times, expected 1", len(bindings.Get()))
+	}
+	b := bindings.Get()[0]
+	if !b.IP.Equal(local.IP) || b.Port != local.Port || b.Transport != TRANSPORT_UDP || b.Username != token+":h6vY" || b.Software != "libwebrtc" {
+		utils.TErrorf(t, "Invalid binding: %+v", b)
+	}
+
+	// plain request, answered but not reported
+	response, local = exchange(bindingRequest("").Encode(nil), t)
+	assertMappedAddress(response, local, t)
+	if len(bindings.Get()) != 1 {
+		utils.TErrorf(t, "Request without username reported")
+	}
+
+	for _, c := range []struct {
+		username string
+		password []byte
+	}{
+		{username: "unknown:h6vY", password: []byte(server.Password("unknown"))},
+		{username: token + ":h6vY", password: []byte("wrong password")},
+	} {
+		response, _ = exchange(bindingRequest(c.username).Encode(c.password), t)
+		if response.Type != METHOD_BINDING|CLASS_ERROR {
+			utils.TErrorf(t, "Invalid response type for %s: %04x", c.username, response.Type)
+		}
+		if code, _ := response.Get(ATTR_ERROR_CODE); len(code) < 4 || int(code[2])*100+int(code[3]) != ERROR_UNAUTHORIZED {
+			utils.TErrorf(t, "Invalid error code: %x", code)
+		}
+	}
+	if len(bindings.Get()) != 1 {
+		utils.TErrorf(t, "Unauthorized request reported")
+	}
+}
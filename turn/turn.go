@@ -0,0 +1,450 @@
+// Package turn implements a minimal TURN server (RFC 8656) supporting
+// allocations, permissions and refreshes over UDP, TCP and TLS. It neither
+// relays data nor binds relay ports: allocating is enough for browsers to
+// reveal the transports through which they reach the helper. Clients
+// authenticate with short-lived credentials minted for a session token, under
+// which they are reported.
+package turn
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"zeroleaks/registry"
+	"zeroleaks/stun"
+	"zeroleaks/utils"
+)
+
+const (
+	TURN_LOG_TAG = "TURN server:"
+	REALM        = "zeroleaks"
+
+	METHOD_ALLOCATE          = 0x0003
+	METHOD_REFRESH           = 0x0004
+	METHOD_CREATE_PERMISSION = 0x0008
+
+	ATTR_LIFETIME                 = 0x000d
+	ATTR_XOR_PEER_ADDRESS         = 0x0012
+	ATTR_REALM                    = 0x0014
+	ATTR_NONCE                    = 0x0015
+	ATTR_XOR_RELAYED_ADDRESS      = 0x0016
+	ATTR_REQUESTED_ADDRESS_FAMILY = 0x0017
+	ATTR_REQUESTED_TRANSPORT      = 0x0019
+
+	ERROR_ALLOCATION_MISMATCH            = 437
+	ERROR_STALE_NONCE                    = 438
+	ERROR_ADDRESS_FAMILY_NOT_SUPPORTED   = 440
+	ERROR_WRONG_CREDENTIALS              = 441
+	ERROR_UNSUPPORTED_TRANSPORT_PROTOCOL = 442
+	ERROR_ALLOCATION_QUOTA_REACHED       = 486
+
+	// protocol number of UDP, the only relayed transport
+	PROTOCOL_UDP = 17
+
+	DEFAULT_LIFETIME = 10 * time.Minute
+	// Allocations of a username beyond this number are rejected.
+	MAX_ALLOCATIONS     = 16
+	MAX_LIFETIME        = time.Hour
+	PERMISSION_LIFETIME = 5 * time.Minute
+	// Nonces are valid during the period in which they are issued and the
+	// next one.
+	NONCE_PERIOD = 10 * time.Minute
+	// TCP and TLS connections holding an allocation are closed when no
+	// message is received within this duration, and the others within the
+	// timeout of the server.
+	IDLE_TIMEOUT = MAX_LIFETIME
+	// TCP and TLS connections beyond this number are closed right away.
+	MAX_CONNECTIONS = 1024
+
+	MAX_PACKET_SIZE = 1500
+
+	// range of the relay ports
+	EPHEMERAL_PORT_MIN = 49152
+	EPHEMERAL_PORT_MAX = 65535
+
+	TRANSPORT_UDP = "udp"
+	TRANSPORT_TCP = "tcp"
+	TRANSPORT_TLS = "tls"
+)
+
+type allocation struct {
+	// relayPort is advertised as the port of the relay, which isn't bound
+	// as no data is relayed.
+	relayPort int
+	username  string
+	timer     *time.Timer
+	// permissions maps the IPs of peers to the expiration of their
+	// permission. They are only kept for refreshes, as no data is relayed.
+	permissions map[string]time.Time
+}
+
+type Server struct {
+	// secret authenticates credentials and nonces.
+	secret   []byte
+	timeout  time.Duration
+	sessions *registry.Registry[string, stun.Binding, struct{}]
+	// relayIPs are the public addresses of the helper, advertised as the
+	// address of the relays.
+	relayIPs []net.IP
+	// allocations are keyed by the transport and the address of their
+	// client.
+	mutex       sync.Mutex
+	allocations map[string]*allocation
+	// connections holds a value for each open TCP or TLS connection.
+	connections chan struct{}
+}
+
+// NewServer creates a server whose sessions and credentials expire after
+// timeout.
+func NewServer(timeout time.Duration, relayIPs []net.IP) *Server {
+	return &Server{
+		secret:      utils.RandomBytes(32),
+		timeout:     timeout,
+		sessions:    registry.New[string, stun.Binding, struct{}](timeout),
+		relayIPs:    relayIPs,
+		allocations: make(map[string]*allocation),
+		connections: make(chan struct{}, MAX_CONNECTIONS),
+	}
+}
+
+// RegisterCallback adds f to the observers of the session token k. inUse is
+// true if k was already registered.
+func (s *Server) RegisterCallback(k string, f func(stun.Binding)) (id uint64, inUse bool) {
+	return s.sessions.Register(k, struct{}{}, f)
+}
+
+func (s *Server) Unregister(k string, id uint64) {
+	s.sessions.Unregister(k, id)
+}
+
+func (s *Server) password(username string) string {
+	mac := hmac.New(sha1.New, s.secret)
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Credentials returns the username and password with which clients of the
+// session token k authenticate, valid until the session expires. The
+// username is the expiration timestamp followed by k, as in the TURN REST
+// API.
+func (s *Server) Credentials(k string) (username string, password string) {
+	username = strconv.FormatInt(time.Now().Add(s.timeout).Unix(), 10) + ":" + k
+	return username, s.password(username)
+}
+
+func nonceEpoch(now time.Time) int64 {
+	return now.UnixNano() / int64(NONCE_PERIOD)
+}
+
+func (s *Server) nonce(epoch int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(binary.BigEndian.AppendUint64([]byte("nonce"), uint64(epoch)))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (s *Server) validNonce(nonce string) bool {
+	epoch := nonceEpoch(time.Now())
+	return nonce == s.nonce(epoch) || nonce == s.nonce(epoch-1)
+}
+
+// authenticate returns the token and the key of the client which sent
+// request, or an error code.
+func (s *Server) authenticate(request *stun.Message) (token string, key []byte, code int) {
+	username, hasUsername := request.Get(stun.ATTR_USERNAME)
+	_, hasIntegrity := request.Get(stun.ATTR_MESSAGE_INTEGRITY)
+	if !hasUsername || !hasIntegrity {
+		return "", nil, stun.ERROR_UNAUTHORIZED
+	}
+	if nonce, _ := request.Get(ATTR_NONCE); !s.validNonce(string(nonce)) {
+		return "", nil, ERROR_STALE_NONCE
+	}
+	expiration, token, _ := strings.Cut(string(username), ":")
+	timestamp, err := strconv.ParseInt(expiration, 10, 64)
+	if err != nil || time.Now().Unix() > timestamp {
+		return "", nil, stun.ERROR_UNAUTHORIZED
+	}
+	sum := md5.Sum([]byte(string(username) + ":" + REALM + ":" + s.password(string(username))))
+	if !request.CheckIntegrity(sum[:]) {
+		return "", nil, stun.ERROR_UNAUTHORIZED
+	}
+	return token, sum[:], 0
+}
+
+func errorResponse(request *stun.Message, code int, reason string) *stun.Message {
+	response := request.Response(stun.CLASS_ERROR)
+	response.AddError(code, reason)
+	return response
+}
+
+// lifetime returns the lifetime requested by request, DEFAULT_LIFETIME if
+// none, up to MAX_LIFETIME. It returns 0 to delete an allocation.
+func lifetime(request *stun.Message) time.Duration {
+	value, ok := request.Get(ATTR_LIFETIME)
+	if !ok || len(value) != 4 {
+		return DEFAULT_LIFETIME
+	}
+	d := time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+	return min(d, MAX_LIFETIME)
+}
+
+func addLifetime(response *stun.Message, d time.Duration) {
+	response.Add(ATTR_LIFETIME, binary.BigEndian.AppendUint32(nil, uint32(d.Seconds())))
+}
+
+// relayIP returns the relay address of the family requested by request.
+func (s *Server) relayIP(request *stun.Message) (net.IP, bool) {
+	ipv6 := false
+	if family, ok := request.Get(ATTR_REQUESTED_ADDRESS_FAMILY); ok && len(family) > 0 {
+		ipv6 = family[0] == stun.FAMILY_IPV6
+	}
+	for _, ip := range s.relayIPs {
+		if (ip.To4() == nil) == ipv6 {
+			return ip, true
+		}
+	}
+	return nil, false
+}
+
+func (s *Server) allocate(key string, username string, request *stun.Message, response *stun.Message) *stun.Message {
+	if transport, _ := request.Get(ATTR_REQUESTED_TRANSPORT); len(transport) != 4 || transport[0] != PROTOCOL_UDP {
+		return errorResponse(request, ERROR_UNSUPPORTED_TRANSPORT_PROTOCOL, "Unsupported Transport Protocol")
+	}
+	ip, ok := s.relayIP(request)
+	if !ok {
+		return errorResponse(request, ERROR_ADDRESS_FAMILY_NOT_SUPPORTED, "Address Family not Supported")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.allocations[key]; ok {
+		return errorResponse(request, ERROR_ALLOCATION_MISMATCH, "Allocation Mismatch")
+	}
+	count := 0
+	for _, a := range s.allocations {
+		if a.username == username {
+			count++
+		}
+	}
+	if count >= MAX_ALLOCATIONS {
+		return errorResponse(request, ERROR_ALLOCATION_QUOTA_REACHED, "Allocation Quota Reached")
+	}
+	d := lifetime(request)
+	if d == 0 {
+		d = DEFAULT_LIFETIME
+	}
+	a := &allocation{
+		relayPort:   EPHEMERAL_PORT_MIN + rand.IntN(EPHEMERAL_PORT_MAX-EPHEMERAL_PORT_MIN+1),
+		username:    username,
+		timer:       time.AfterFunc(d, func() { s.deallocate(key) }),
+		permissions: make(map[string]time.Time),
+	}
+	s.allocations[key] = a
+	response.AddXorAddress(ATTR_XOR_RELAYED_ADDRESS, ip, a.relayPort)
+	addLifetime(response, d)
+	return response
+}
+
+func (s *Server) allocated(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.allocations[key]
+	return ok
+}
+
+func (s *Server) deallocate(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if a, ok := s.allocations[key]; ok {
+		s.remove(key, a)
+	}
+}
+
+// remove releases the allocation a of key. It must be called with the mutex
+// held.
+func (s *Server) remove(key string, a *allocation) {
+	a.timer.Stop()
+	delete(s.allocations, key)
+}
+
+// existingAllocation returns the allocation of key, which must belong to
+// username. It must be called with the mutex held.
+func (s *Server) existingAllocation(key string, username string, request *stun.Message) (*allocation, *stun.Message) {
+	a, ok := s.allocations[key]
+	if !ok {
+		return nil, errorResponse(request, ERROR_ALLOCATION_MISMATCH, "Allocation Mismatch")
+	}
+	if a.username != username {
+		return nil, errorResponse(request, ERROR_WRONG_CREDENTIALS, "Wrong Credentials")
+	}
+	return a, nil
+}
+
+func (s *Server) refresh(key string, username string, request *stun.Message, response *stun.Message) *stun.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	a, errResponse := s.existingAllocation(key, username, request)
+	if errResponse != nil {
+		return errResponse
+	}
+	d := lifetime(request)
+	if d == 0 {
+		s.remove(key, a)
+	} else {
+		a.timer.Reset(d)
+	}
+	addLifetime(response, d)
+	return response
+}
+
+func (s *Server) createPermission(key string, username string, request *stun.Message, response *stun.Message) *stun.Message {
+	peer, _, ok := request.XorAddress(ATTR_XOR_PEER_ADDRESS)
+	if !ok {
+		return errorResponse(request, stun.ERROR_BAD_REQUEST, "Bad Request")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	a, errResponse := s.existingAllocation(key, username, request)
+	if errResponse != nil {
+		return errResponse
+	}
+	a.permissions[peer.String()] = time.Now().Add(PERMISSION_LIFETIME)
+	return response
+}
+
+// handle returns the response to the request in packet, or nil if it must
+// not be answered.
+func (s *Server) handle(src net.IP, port int, transport string, packet []byte) []byte {
+	request, err := stun.Parse(packet)
+	if err != nil {
+		log.Printf("%s Error: invalid message received from %s: %s", TURN_LOG_TAG, net.JoinHostPort(src.String(), strconv.Itoa(port)), err)
+		return nil
+	}
+	if request.Class() != stun.CLASS_REQUEST {
+		// Send indications are dropped, as no data is relayed
+		return nil
+	}
+	if request.Method() == stun.METHOD_BINDING {
+		response := request.Response(stun.CLASS_SUCCESS)
+		response.AddXorAddress(stun.ATTR_XOR_MAPPED_ADDRESS, src, port)
+		return response.Encode(nil)
+	}
+	token, key, code := s.authenticate(request)
+	if code != 0 {
+		// the client retries with the realm and nonce of the error response
+		response := errorResponse(request, code, "Unauthorized")
+		if code == ERROR_STALE_NONCE {
+			response = errorResponse(request, code, "Stale Nonce")
+		}
+		response.Add(ATTR_REALM, []byte(REALM))
+		response.Add(ATTR_NONCE, []byte(s.nonce(nonceEpoch(time.Now()))))
+		return response.Encode(nil)
+	}
+	username, _ := request.Get(stun.ATTR_USERNAME)
+	binding := stun.Binding{IP: src, Port: port, Transport: transport, Username: string(username), Relay: true}
+	if software, ok := request.Get(stun.ATTR_SOFTWARE); ok {
+		binding.Software = string(software)
+	}
+	s.sessions.Notify(token, binding)
+	allocationKey := transport + " " + net.JoinHostPort(src.String(), strconv.Itoa(port))
+	response := request.Response(stun.CLASS_SUCCESS)
+	switch request.Method() {
+	case METHOD_ALLOCATE:
+		response = s.allocate(allocationKey, string(username), request, response)
+		if response.Class() == stun.CLASS_SUCCESS {
+			response.AddXorAddress(stun.ATTR_XOR_MAPPED_ADDRESS, src, port)
+		}
+	case METHOD_REFRESH:
+		response = s.refresh(allocationKey, string(username), request, response)
+	case METHOD_CREATE_PERMISSION:
+		response = s.createPermission(allocationKey, string(username), request, response)
+	default:
+		response = errorResponse(request, stun.ERROR_BAD_REQUEST, "Unsupported method")
+	}
+	return response.Encode(key)
+}
+
+func (s *Server) ServeUDP(conn net.PacketConn) {
+	buff := make([]byte, MAX_PACKET_SIZE)
+	for {
+		n, src, err := conn.ReadFrom(buff)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("%s Error while reading UDP packet from %s: %s", TURN_LOG_TAG, src, err)
+			continue
+		}
+		udpAddr := src.(*net.UDPAddr)
+		if response := s.handle(udpAddr.IP, udpAddr.Port, TRANSPORT_UDP, buff[:n]); response != nil {
+			if _, err := conn.WriteTo(response, src); err != nil {
+				log.Printf("%s Error while sending UDP packet to %s: %s", TURN_LOG_TAG, src, err)
+			}
+		}
+	}
+}
+
+// ServeTCP accepts connections on l, over which messages are framed by
+// their own length. transport is TRANSPORT_TCP or TRANSPORT_TLS.
+func (s *Server) ServeTCP(l net.Listener, transport string) {
+	for {
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("%s Error while accepting %s connection: %s", TURN_LOG_TAG, transport, err)
+			continue
+		}
+		select {
+		case s.connections <- struct{}{}:
+			go s.handleConn(c, transport)
+		default:
+			log.Printf("%s Error: too many connections, closing %s connection from %s", TURN_LOG_TAG, transport, c.RemoteAddr())
+			c.Close()
+		}
+	}
+}
+
+func (s *Server) handleConn(c net.Conn, transport string) {
+	defer func() { <-s.connections }()
+	defer c.Close()
+	src := c.RemoteAddr().(*net.TCPAddr)
+	key := transport + " " + src.String()
+	// allocations over TCP and TLS end with their connection
+	defer s.deallocate(key)
+	header := make([]byte, stun.HEADER_SIZE)
+	for {
+		// the credentials of connections without allocation expire with
+		// the timeout of the server
+		idle := s.timeout
+		if s.allocated(key) {
+			idle = IDLE_TIMEOUT
+		}
+		c.SetReadDeadline(time.Now().Add(idle))
+		if _, err := io.ReadFull(c, header); err != nil {
+			return
+		}
+		packet := make([]byte, stun.HEADER_SIZE+int(binary.BigEndian.Uint16(header[2:4])))
+		copy(packet, header)
+		if _, err := io.ReadFull(c, packet[stun.HEADER_SIZE:]); err != nil {
+			return
+		}
+		if response := s.handle(src.IP, src.Port, transport, packet); response != nil {
+			if _, err := c.Write(response); err != nil {
+				return
+			}
+		}
+	}
+}
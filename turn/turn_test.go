@@ -0,0 +1,239 @@
+package turn
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+	"zeroleaks/stun"
+	"zeroleaks/utils"
+)
+
+const timeout = time.Second
+
+var server *Server
+var udpAddr, tcpAddr net.Addr
+
+func TestMain(m *testing.M) {
+	server = NewServer(timeout, []net.IP{net.IPv4(127, 0, 0, 1)})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	udpAddr, tcpAddr = conn.LocalAddr(), l.Addr()
+	go server.ServeUDP(conn)
+	go server.ServeTCP(l, TRANSPORT_TCP)
+	os.Exit(m.Run())
+}
+
+func dial(network string, t *testing.T) net.Conn {
+	addr := udpAddr
+	if network == "tcp" {
+		addr = tcpAddr
+	}
+	c, err := net.Dial(network, addr.String())
+	if err != nil {
+		utils.TFatalf(t, "Failed to connect to the TURN server: %s", err)
+	}
+	return c
+}
+
+// exchange sends request over c and returns the response.
+func exchange(c net.Conn, request *stun.Message, key []byte, t *testing.T) *stun.Message {
+	if _, err := c.Write(request.Encode(key)); err != nil {
+		utils.TFatalf(t, "Failed to send request: %s", err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	buff := make([]byte, MAX_PACKET_SIZE)
+	var n int
+	var err error
+	if _, ok := c.(*net.TCPConn); ok {
+		n, err = io.ReadFull(c, buff[:stun.HEADER_SIZE])
+		if err == nil {
+			length := int(binary.BigEndian.Uint16(buff[2:4]))
+			_, err = io.ReadFull(c, buff[n:n+length])
+			n += length
+		}
+	} else {
+		n, err = c.Read(buff)
+	}
+	if err != nil {
+		utils.TFatalf(t, "Failed to read response: %s", err)
+	}
+	response, err := stun.Parse(buff[:n])
+	if err != nil {
+		utils.TFatalf(t, "Failed to parse response: %s", err)
+	}
+	return response
+}
+
+func newRequest(method uint16, username string, nonce []byte) *stun.Message {
+	request := &stun.Message{Type: method | stun.CLASS_REQUEST}
+	copy(request.TransactionId[:], utils.RandomBytes(stun.TRANSACTION_ID_SIZE))
+	if username != "" {
+		request.Add(stun.ATTR_USERNAME, []byte(username))
+		request.Add(ATTR_REALM, []byte(REALM))
+		request.Add(ATTR_NONCE, nonce)
+	}
+	return request
+}
+
+func assertError(response *stun.Message, code int, t *testing.T) {
+	value, _ := response.Get(stun.ATTR_ERROR_CODE)
+	if response.Class() != stun.CLASS_ERROR || len(value) < 4 || int(value[2])*100+int(value[3]) != code {
+		utils.TErrorf(t, "Invalid response: got %04x %x, expected error %d", response.Type, value, code)
+	}
+}
+
+func assertSuccess(response *stun.Message, key []byte, t *testing.T) {
+	if response.Class() != stun.CLASS_SUCCESS {
+		value, _ := response.Get(stun.ATTR_ERROR_CODE)
+		utils.TFatalf(t, "Request failed: %04x %x", response.Type, value)
+	}
+	if !response.CheckIntegrity(key) {
+		utils.TErrorf(t, "Invalid integrity of the response")
+	}
+}
+
+func allocateRequest(username string, nonce []byte) *stun.Message {
+	request := newRequest(METHOD_ALLOCATE, username, nonce)
+	request.Add(ATTR_REQUESTED_TRANSPORT, []byte{PROTOCOL_UDP, 0, 0, 0})
+	return request
+}
+
+func TestAllocation(t *testing.T) {
+	token := "0123456789abcdef"
+	bindings := new(utils.Recorder[stun.Binding])
+	id, _ := server.RegisterCallback(token, bindings.Add)
+	defer server.Unregister(token, id)
+	username, password := server.Credentials(token)
+	sum := md5.Sum([]byte(username + ":" + REALM + ":" + password))
+	key := sum[:]
+
+	c := dial("udp", t)
+	defer c.Close()
+	response := exchange(c, allocateRequest("", nil), nil, t)
+	assertError(response, stun.ERROR_UNAUTHORIZED, t)
+	nonce, _ := response.Get(ATTR_NONCE)
+	if realm, _ := response.Get(ATTR_REALM); string(realm) != REALM || len(nonce) == 0 {
+		utils.TFatalf(t, "Invalid realm or nonce: %q %q", realm, nonce)
+	}
+	assertError(exchange(c, allocateRequest(username, []byte("stale")), key, t), ERROR_STALE_NONCE, t)
+	assertError(exchange(c, allocateRequest(username, nonce), []byte("wrong key"), t), stun.ERROR_UNAUTHORIZED, t)
+	if len(bindings.Get()) != 0 {
+		utils.TErrorf(t, "Unauthenticated request reported")
+	}
+
+	response = exchange(c, allocateRequest(username, nonce), key, t)
+	assertSuccess(response, key, t)
+	relayIP, relayPort, ok := response.XorAddress(ATTR_XOR_RELAYED_ADDRESS)
+	if !ok || !relayIP.Equal(net.IPv4(127, 0, 0, 1)) || relayPort == 0 {
+		utils.TErrorf(t, "Invalid relayed address: %s %d", relayIP, relayPort)
+	}
+	local := c.LocalAddr().(*net.UDPAddr)
+	if ip, port, _ := response.XorAddress(stun.ATTR_XOR_MAPPED_ADDRESS); !ip.Equal(local.IP) || port != local.Port {
+		utils.TErrorf(t, "Invalid mapped address: %s %d", ip, port)
+	}
+	if len(bindings.Get()) != 1 {
+		utils.TFatalf(t, "Callback called %d times, expected 1", len(bindings.Get()))
+	}
+	b := bindings.Get()[0]
+	if !b.IP.Equal(local.IP) || b.Port != local.Port || b.Transport != TRANSPORT_UDP || b.Username != username || !b.Relay {
+		utils.TErrorf(t, "Invalid binding: %+v", b)
+	}
+	assertError(exchange(c, allocateRequest(username, nonce), key, t), ERROR_ALLOCATION_MISMATCH, t)
+
+	request := newRequest(METHOD_CREATE_PERMISSION, username, nonce)
+	request.AddXorAddress(ATTR_XOR_PEER_ADDRESS, net.IPv4(192, 0, 2, 1), 0)
+	assertSuccess(exchange(c, request, key, t), key, t)
+
+	request = newRequest(METHOD_REFRESH, username, nonce)
+	request.Add(ATTR_LIFETIME, []byte{0, 0, 0, 0})
+	assertSuccess(exchange(c, request, key, t), key, t)
+	assertError(exchange(c, request, key, t), ERROR_ALLOCATION_MISMATCH, t)
+}
+
+func TestTCPAllocation(t *testing.T) {
+	token := "fedcba9876543210"
+	bindings := new(utils.Recorder[stun.Binding])
+	id, _ := server.RegisterCallback(token, bindings.Add)
+	defer server.Unregister(token, id)
+	username, password := server.Credentials(token)
+	sum := md5.Sum([]byte(username + ":" + REALM + ":" + password))
+
+	c := dial("tcp", t)
+	nonce, _ := exchange(c, allocateRequest("", nil), nil, t).Get(ATTR_NONCE)
+	assertSuccess(exchange(c, allocateRequest(username, nonce), sum[:], t), sum[:], t)
+	if b := bindings.Get(); len(b) != 1 || b[0].Transport != TRANSPORT_TCP {
+		utils.TErrorf(t, "Invalid bindings: %+v", b)
+	}
+	key := TRANSPORT_TCP + " " + c.LocalAddr().String()
+	c.Close()
+	time.Sleep(10 * time.Millisecond) // let the server notice the closed connection
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if _, ok := server.allocations[key]; ok {
+		utils.TErrorf(t, "Allocation not released with its connection")
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	c := dial("tcp", t)
+	defer c.Close()
+	// unauthenticated connections are closed after the timeout of the server
+	c.SetReadDeadline(time.Now().Add(timeout + time.Second))
+	start := time.Now()
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		utils.TFatalf(t, "Connection not closed by the server: %v", err)
+	}
+	if d := time.Since(start); d < timeout {
+		utils.TErrorf(t, "Connection closed after %s, before the timeout", d)
+	}
+}
+
+func TestAllocationLimits(t *testing.T) {
+	token := "00112233445566778899"
+	id, _ := server.RegisterCallback(token, func(stun.Binding) {})
+	defer server.Unregister(token, id)
+	username, password := server.Credentials(token)
+	sum := md5.Sum([]byte(username + ":" + REALM + ":" + password))
+	key := sum[:]
+
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	var nonce []byte
+	for i := range MAX_ALLOCATIONS + 1 {
+		c := dial("udp", t)
+		conns = append(conns, c)
+		if nonce == nil {
+			nonce, _ = exchange(c, allocateRequest("", nil), nil, t).Get(ATTR_NONCE)
+		}
+		request := allocateRequest(username, nonce)
+		request.Add(ATTR_LIFETIME, binary.BigEndian.AppendUint32(nil, 30))
+		response := exchange(c, request, key, t)
+		if i == MAX_ALLOCATIONS {
+			assertError(response, ERROR_ALLOCATION_QUOTA_REACHED, t)
+			break
+		}
+		assertSuccess(response, key, t)
+		// lifetimes shorter than the default are honoured
+		if value, _ := response.Get(ATTR_LIFETIME); binary.BigEndian.Uint32(value) != 30 {
+			utils.TErrorf(t, "Invalid lifetime: got %d, expected 30", binary.BigEndian.Uint32(value))
+		}
+	}
+	request := newRequest(METHOD_REFRESH, username, nonce)
+	request.Add(ATTR_LIFETIME, []byte{0, 0, 0, 0})
+	assertSuccess(exchange(conns[0], request, key, t), key, t)
+	assertSuccess(exchange(conns[MAX_ALLOCATIONS], allocateRequest(username, nonce), key, t), key, t)
+}
@@ -7,6 +7,8 @@ import (
 	"log"
 	"net"
 	"runtime/debug"
+	"slices"
+	"sync"
 	"testing"
 )
 
@@ -50,3 +52,23 @@ func TFatalf(t *testing.T, format string, args ...any) {
 	LogStack(t)
 	t.Fatalf(format, args...)
 }
+
+// Recorder collects the values passed to a callback run by a server, in
+// another goroutine than the test.
+type Recorder[T any] struct {
+	mutex  sync.Mutex
+	values []T
+}
+
+func (r *Recorder[T]) Add(v T) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.values = append(r.values, v)
+}
+
+// Get returns a copy of the values recorded so far.
+func (r *Recorder[T]) Get() []T {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return slices.Clone(r.values)
+}
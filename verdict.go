@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"zeroleaks/ip2asn"
+)
+
+const MESSAGE_VERDICT = "verdict"
+
+// Classes of the addresses seen by the tests, relative to the client.
+const (
+	// CLASS_SAME_NETWORK addresses share the SAME_NETWORK_PREFIX_V4 or
+	// SAME_NETWORK_PREFIX_V6 of the client.
+	CLASS_SAME_NETWORK      = "same_network"
+	CLASS_SAME_ASN          = "same_asn"
+	CLASS_DIFFERENT_COUNTRY = "different_country"
+	// CLASS_BOGON addresses are private or reserved, and not routed on the
+	// internet.
+	CLASS_BOGON = "bogon"
+	// CLASS_FAMILY_MISMATCH addresses are IPv6 while the client connected
+	// over IPv4, or the reverse.
+	CLASS_FAMILY_MISMATCH = "family_mismatch"
+)
+
+const (
+	SAME_NETWORK_PREFIX_V4 = 24
+	SAME_NETWORK_PREFIX_V6 = 48
+)
+
+// asnDB is nil if Verdict.ip2asn isn't set.
+var asnDB *ip2asn.DB
+
+// trustedProxies are the reverse proxies whose X-Forwarded-For headers are
+// honoured.
+var trustedProxies []netip.Prefix
+
+var bogonPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/3"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// globalUnicast is the only IPv6 range allocated to the internet.
+var globalUnicast = netip.MustParsePrefix("2000::/3")
+
+// verdictMessage is sent by the v2 protocol after the done messages, when
+// the address of the client is known.
+type verdictMessage struct {
+	Type string `json:"type"`
+	// ClientIP is the address of the websocket client.
+	ClientIP      string `json:"client_ip"`
+	ClientASN     uint32 `json:"client_asn,omitempty"`
+	ClientCountry string `json:"client_country,omitempty"`
+	// Leaked is true if one of Addresses is a leak.
+	Leaked bool `json:"leaked"`
+	// Addresses are the addresses other than ClientIP seen by the tests.
+	Addresses []addressVerdict `json:"addresses"`
+}
+
+type addressVerdict struct {
+	IP string `json:"ip"`
+	// Tests are the tests which saw the address.
+	Tests   []string `json:"tests"`
+	ASN     uint32   `json:"asn,omitempty"`
+	Country string   `json:"country,omitempty"`
+	Classes []string `json:"classes"`
+	// Leak is false for the addresses of the network or autonomous system
+	// of the client, such as the resolver of its ISP or VPN provider.
+	Leak bool `json:"leak"`
+}
+
+// newVerdict compares the addresses seen by the tests with clientIP.
+func newVerdict(clientIP string, results []doneMessage) verdictMessage {
+	verdict := verdictMessage{Type: MESSAGE_VERDICT, ClientIP: clientIP, Addresses: []addressVerdict{}}
+	client, _ := netip.ParseAddr(clientIP)
+	client = client.Unmap()
+	var clientEntry ip2asn.Entry
+	if asnDB != nil {
+		clientEntry, _ = asnDB.Lookup(client.AsSlice())
+		verdict.ClientASN, verdict.ClientCountry = clientEntry.ASN, clientEntry.Country
+	}
+	// index of each address in verdict.Addresses
+	indexes := make(map[netip.Addr]int)
+	for _, result := range results {
+		for _, s := range result.IPs {
+			ip, err := netip.ParseAddr(s)
+			ip = ip.Unmap()
+			if err != nil || ip == client {
+				continue
+			}
+			i, ok := indexes[ip]
+			if !ok {
+				i = len(verdict.Addresses)
+				indexes[ip] = i
+				verdict.Addresses = append(verdict.Addresses, classify(client, clientEntry, ip))
+			}
+			if address := &verdict.Addresses[i]; !slices.Contains(address.Tests, result.Test) {
+				address.Tests = append(address.Tests, result.Test)
+			}
+		}
+	}
+	for _, address := range verdict.Addresses {
+		verdict.Leaked = verdict.Leaked || address.Leak
+	}
+	return verdict
+}
+
+// classify compares ip with the address of the client, and with its entry in
+// asnDB if any.
+func classify(client netip.Addr, clientEntry ip2asn.Entry, ip netip.Addr) addressVerdict {
+	address := addressVerdict{IP: ip.String(), Classes: []string{}, Leak: true}
+	if isBogon(ip) {
+		address.Classes = append(address.Classes, CLASS_BOGON)
+	}
+	if ip.Is4() != client.Is4() {
+		address.Classes = append(address.Classes, CLASS_FAMILY_MISMATCH)
+	} else {
+		bits := SAME_NETWORK_PREFIX_V6
+		if ip.Is4() {
+			bits = SAME_NETWORK_PREFIX_V4
+		}
+		if network, _ := client.Prefix(bits); network.Contains(ip) {
+			address.Classes = append(address.Classes, CLASS_SAME_NETWORK)
+			address.Leak = false
+		}
+	}
+	if asnDB == nil {
+		return address
+	}
+	if entry, ok := asnDB.Lookup(ip.AsSlice()); ok {
+		address.ASN, address.Country = entry.ASN, entry.Country
+		if clientEntry.ASN != 0 && entry.ASN == clientEntry.ASN {
+			address.Classes = append(address.Classes, CLASS_SAME_ASN)
+			address.Leak = false
+		}
+		if clientEntry.Country != "" && entry.Country != "" && entry.Country != clientEntry.Country {
+			address.Classes = append(address.Classes, CLASS_DIFFERENT_COUNTRY)
+		}
+	}
+	return address
+}
+
+func isBogon(ip netip.Addr) bool {
+	if ip.Is6() && !globalUnicast.Contains(ip) {
+		return true
+	}
+	for _, prefix := range bogonPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses addresses and networks in CIDR notation.
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, err
+			}
+			proxy = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()).String()
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func isTrustedProxy(ip netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address and port of the client of r, or a nil
+// address if it is invalid. The X-Forwarded-For header of requests from
+// trusted proxies is walked back to the first address which isn't a trusted
+// proxy, in which case the port of the client is unknown and 0.
+func clientAddr(r *http.Request) (net.IP, int) {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, 0
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil, 0
+	}
+	p, _ := strconv.Atoi(port)
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(ip); i-- {
+		next, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		ip, p = next, 0
+	}
+	return net.IP(ip.Unmap().AsSlice()), p
+}
+
+// clientIP returns the address of the client of r, as resolved by
+// clientAddr, or an empty string if it is invalid.
+func clientIP(r *http.Request) string {
+	ip, _ := clientAddr(r)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
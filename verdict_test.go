@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"zeroleaks/ip2asn"
+	"zeroleaks/utils"
+)
+
+const asnDatabase = `8.8.8.0	8.8.8.255	15169	US	GOOGLE
+9.9.9.0	9.9.9.255	19281	CH	QUAD9-AS-1
+185.0.0.0	185.0.255.255	64500	FR	EXAMPLE-VPN
+2a00::	2a00:ffff:ffff:ffff:ffff:ffff:ffff:ffff	64501	DE	EXAMPLE-ISP
+`
+
+func TestNewVerdict(t *testing.T) {
+	db, err := ip2asn.Parse(strings.NewReader(asnDatabase))
+	if err != nil {
+		utils.TFatalf(t, "Failed to parse database: %s", err)
+	}
+	asnDB = db
+	defer func() { asnDB = nil }()
+	results := []doneMessage{
+		{Test: TEST_DNS, IPs: []string{"185.0.0.1", "185.0.1.53", "185.0.0.53", "8.8.8.8", "2a00::1"}},
+		{Test: TEST_BITTORRENT, IPs: []string{"185.0.0.1", "192.168.1.10", "8.8.8.8"}},
+		{Test: TEST_WEBRTC, IPs: []string{}},
+	}
+	verdict := newVerdict("185.0.0.1", results)
+	if verdict.Type != MESSAGE_VERDICT || verdict.ClientIP != "185.0.0.1" || verdict.ClientASN != 64500 || verdict.ClientCountry != "FR" || !verdict.Leaked {
+		utils.TErrorf(t, "Invalid verdict: %+v", verdict)
+	}
+	expected := []addressVerdict{
+		{IP: "185.0.1.53", Tests: []string{TEST_DNS}, ASN: 64500, Country: "FR", Classes: []string{CLASS_SAME_ASN}},
+		{IP: "185.0.0.53", Tests: []string{TEST_DNS}, ASN: 64500, Country: "FR", Classes: []string{CLASS_SAME_NETWORK, CLASS_SAME_ASN}},
+		{IP: "8.8.8.8", Tests: []string{TEST_DNS, TEST_BITTORRENT}, ASN: 15169, Country: "US", Classes: []string{CLASS_DIFFERENT_COUNTRY}, Leak: true},
+		{IP: "2a00::1", Tests: []string{TEST_DNS}, ASN: 64501, Country: "DE", Classes: []string{CLASS_FAMILY_MISMATCH, CLASS_DIFFERENT_COUNTRY}, Leak: true},
+		{IP: "192.168.1.10", Tests: []string{TEST_BITTORRENT}, Classes: []string{CLASS_BOGON}, Leak: true},
+	}
+	if len(verdict.Addresses) != len(expected) {
+		utils.TFatalf(t, "Invalid verdict addresses: got %+v, expected %+v", verdict.Addresses, expected)
+	}
+	for i, address := range verdict.Addresses {
+		e := expected[i]
+		if address.IP != e.IP || !slices.Equal(address.Tests, e.Tests) || address.ASN != e.ASN || address.Country != e.Country || !slices.Equal(address.Classes, e.Classes) || address.Leak != e.Leak {
+			utils.TErrorf(t, "Invalid verdict address: got %+v, expected %+v", address, e)
+		}
+	}
+
+	verdict = newVerdict("2a00::1", []doneMessage{{Test: TEST_DNS, IPs: []string{"2a00:0:0::1", "2a00::53"}}})
+	if verdict.Leaked || len(verdict.Addresses) != 1 || !slices.Equal(verdict.Addresses[0].Classes, []string{CLASS_SAME_NETWORK, CLASS_SAME_ASN}) {
+		utils.TErrorf(t, "Invalid verdict: %+v", verdict)
+	}
+}
+
+func TestIsBogon(t *testing.T) {
+	for ip, bogon := range map[string]bool{
+		"10.1.2.3":     true,
+		"100.64.0.1":   true,
+		"127.0.0.1":    true,
+		"169.254.1.1":  true,
+		"192.0.2.1":    true,
+		"240.0.0.1":    true,
+		"::1":          true,
+		"fe80::1":      true,
+		"fd00::1":      true,
+		"2001:db8::1":  true,
+		"8.8.8.8":      false,
+		"172.32.0.1":   false,
+		"2a00:1450::1": false,
+	} {
+		if isBogon(netip.MustParseAddr(ip)) != bogon {
+			utils.TErrorf(t, "Invalid bogon status of %s: expected %t", ip, bogon)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+	if err != nil {
+		utils.TFatalf(t, "Failed to parse trusted proxies: %s", err)
+	}
+	trustedProxies = proxies
+	defer func() { trustedProxies = nil }()
+	for _, c := range []struct {
+		remote    string
+		forwarded []string
+		expected  string
+	}{
+		{remote: "198.51.100.1:1234", expected: "198.51.100.1"},
+		{remote: "198.51.100.1:1234", forwarded: []string{"192.0.2.1"}, expected: "198.51.100.1"},
+		{remote: "127.0.0.1:1234", expected: "127.0.0.1"},
+		{remote: "127.0.0.1:1234", forwarded: []string{"192.0.2.1"}, expected: "192.0.2.1"},
+		{remote: "127.0.0.1:1234", forwarded: []string{"203.0.113.1, 192.0.2.1", "10.0.0.2"}, expected: "192.0.2.1"},
+		{remote: "127.0.0.1:1234", forwarded: []string{"10.0.0.3, 10.0.0.2"}, expected: "10.0.0.3"},
+		{remote: "127.0.0.1:1234", forwarded: []string{"unknown, 10.0.0.2"}, expected: "10.0.0.2"},
+		{remote: "[::ffff:127.0.0.1]:1234", forwarded: []string{"2001:db8::1"}, expected: "2001:db8::1"},
+		{remote: "invalid", expected: ""},
+	} {
+		r := &http.Request{RemoteAddr: c.remote, Header: http.Header{"X-Forwarded-For": c.forwarded}}
+		if ip := clientIP(r); ip != c.expected {
+			utils.TErrorf(t, "Invalid client IP for %s %v: got %q, expected %q", c.remote, c.forwarded, ip, c.expected)
+		}
+	}
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		utils.TErrorf(t, "Invalid trusted proxy parsed")
+	}
+}
@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
 	"encoding/hex"
 	"log"
 	"net"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"zeroleaks/bittorrent"
+	"zeroleaks/dns"
+	"zeroleaks/stun"
+	"zeroleaks/turn"
 	"zeroleaks/utils"
 
 	"github.com/coder/websocket"
@@ -19,112 +25,765 @@ import (
 const WS_LOG_TAG = "Websocket server:"
 const DNS_LEAK_TESTS_NUMBER = 6
 
+const (
+	// v1 sends bare IP addresses or test specific JSON objects
+	PROTOCOL_V1 = 1
+	// v2 sends typed JSON messages, see leakEvent
+	PROTOCOL_V2 = 2
+)
+
+const (
+	TEST_DNS        = "dns"
+	TEST_DNSSEC     = "dnssec"
+	TEST_BITTORRENT = "bittorrent"
+	TEST_WEBRTC     = "webrtc"
+)
+
+// Types of the v2 protocol messages.
+const (
+	MESSAGE_PARAMS = "params"
+	MESSAGE_LEAK   = "leak"
+	MESSAGE_DONE   = "done"
+	MESSAGE_ERROR  = "error"
+)
+
+// Codes of the v2 protocol error messages.
+const (
+	ERROR_DNSSEC_DISABLED = "dnssec_disabled"
+	ERROR_WEBRTC_DISABLED = "webrtc_disabled"
+)
+
+const PROTOCOL_HTTP = "http"
+
+// paramsMessage is the first message sent by the v2 protocol. It contains
+// what the client needs to trigger the leaks.
+type paramsMessage struct {
+	Type   string `json:"type"`
+	Test   string `json:"test"`
+	Params any    `json:"params"`
+}
+
+// leakEvent is sent by the v2 protocol for every leak detected.
+type leakEvent struct {
+	Type      string    `json:"type"`
+	Test      string    `json:"test"`
+	IP        string    `json:"ip"`
+	Port      int       `json:"port,omitempty"`
+	Protocol  string    `json:"protocol"`
+	Timestamp time.Time `json:"timestamp"`
+	Subdomain string    `json:"subdomain,omitempty"`
+	InfoHash  string    `json:"info_hash,omitempty"`
+	// Metadata holds details specific to the protocol of the leak.
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+// doneMessage is the last message sent by the v2 protocol before the
+// connection is closed.
+type doneMessage struct {
+	Type string `json:"type"`
+	Test string `json:"test"`
+	// Leaks is the number of leak events sent.
+	Leaks int `json:"leaks"`
+	// IPs are the distinct addresses of the leak events.
+	IPs     []string `json:"ips"`
+	Summary any      `json:"summary,omitempty"`
+}
+
+type errorMessage struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type bittorrentTestParams struct {
+	Magnet   string     `json:"magnet"`
+	InfoHash string     `json:"info_hash"`
+	Echo     echoParams `json:"echo"`
+}
+
+type webrtcTestParams struct {
+	// Username and Password are the ICE credentials (ufrag and pwd) of the
+	// helper, to use as the remote peer of a WebRTC connection.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// URLs are STUN servers for the iceServers of the connection.
+	URLs []string `json:"urls"`
+	// Candidates are the addresses of the helper, as host:port, to add as
+	// remote candidates.
+	Candidates []string `json:"candidates"`
+	// TURN is set if the TURN server is enabled, to add to the iceServers of
+	// the connection.
+	TURN *turnParams `json:"turn,omitempty"`
+	Echo echoParams  `json:"echo"`
+}
+
+// turnParams is the RTCIceServer of the TURN server over every transport.
+type turnParams struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username"`
+	Credential string   `json:"credential"`
+}
+
+// dnsLeakTestParamsV1 are the parameters of the DNS leak test sent to v1
+// clients, which are then only sent the addresses of the resolvers.
+type dnsLeakTestParamsV1 struct {
+	Base       string   `json:"base"`
+	Subdomains []string `json:"subdomains"`
+}
+
 type dnsLeakTestParams struct {
 	Base       string   `json:"base"`
 	Subdomains []string `json:"subdomains"`
+	// Resolvable is true if the subdomains resolve to the helper, in which
+	// case the client can follow up with requests to the probe endpoint.
+	Resolvable bool `json:"resolvable"`
+	// Minimisation is a multi-label subdomain used to detect whether
+	// resolvers minimise query names.
+	Minimisation string     `json:"minimisation"`
+	Echo         echoParams `json:"echo"`
+}
+
+type dnssecTestParams struct {
+	Base   string `json:"base"`
+	Signed string `json:"signed"`
+	Bogus  string `json:"bogus"`
+}
+
+type dnssecSummary struct {
+	// Validating is nil if the signed subdomain could not be reached.
+	Validating    *bool `json:"validating"`
+	SignedReached bool  `json:"signed_reached"`
+	BogusReached  bool  `json:"bogus_reached"`
+}
+
+// httpProbes maps subdomains of conf.DNS.Domain to the callbacks to call when
+// an HTTP request for them is received on the probe endpoint.
+var httpProbes sync.Map
+
+type dnsClientSubnet struct {
+	Family  uint16 `json:"family"`
+	Prefix  uint8  `json:"prefix"`
+	Address string `json:"address"`
+}
+
+type dnsSummary struct {
+	Resolver dns.ResolverFingerprint `json:"resolver"`
+	// QnameMinimisation is nil if the minimisation subdomain wasn't queried.
+	QnameMinimisation *bool `json:"qname_minimisation"`
+}
+
+type leakMessage struct {
+	key string
+	msg any
 }
 
 type IPSender struct {
-	ws       *websocket.Conn
-	ctx      context.Context
-	timeout  time.Duration
-	ch       chan net.IP
-	Callback func(net.IP)
+	ws      *websocket.Conn
+	ctx     context.Context
+	test    string
+	version int
+	timeout time.Duration
+	ch      chan *leakMessage
+	// Summary, if set, is called on timeout. Its result is sent to the
+	// websocket client before the connection is closed.
+	Summary func() any
+	// ClientIP, if set, is the address of the websocket client. A verdict
+	// comparing it with the leaks is sent to v2 clients on timeout.
+	ClientIP string
+	cleanups []func()
+	// root is the sender of the session the sender belongs to, if any, and
+	// subs are the senders of the tests of a session.
+	root *IPSender
+	subs []*IPSender
 }
 
-func NewIPSender(ws *websocket.Conn, ctx context.Context, timeout time.Duration) *IPSender {
-	ch := make(chan net.IP, 32)
+func NewIPSender(ws *websocket.Conn, ctx context.Context, test string, version int, timeout time.Duration) *IPSender {
 	return &IPSender{
 		ws:      ws,
 		ctx:     ctx,
+		test:    test,
+		version: version,
 		timeout: timeout,
-		ch:      ch,
-		Callback: func(ip net.IP) {
-			select {
-			case ch <- ip:
-			default:
-				// websocket connection closed
-			}
-		},
+		ch:      make(chan *leakMessage, 32),
 	}
 }
 
+// Sub returns a sender for test, whose leaks are multiplexed over the
+// connection of s. Its done message is sent when s stops.
+func (s *IPSender) Sub(test string) *IPSender {
+	sub := &IPSender{ws: s.ws, ctx: s.ctx, test: test, version: s.version, timeout: s.timeout, ch: s.ch, root: s}
+	s.subs = append(s.subs, sub)
+	return sub
+}
+
+// Send queues msg for the websocket client unless a message with the same
+// key has already been sent. Strings are sent as text messages, anything
+// else is encoded as JSON.
+func (s *IPSender) Send(key string, msg any) {
+	if s.root != nil {
+		// the tests of a session report the same addresses separately
+		key = s.test + " " + key
+	}
+	select {
+	case s.ch <- &leakMessage{key: key, msg: msg}:
+	default:
+		// websocket connection closed
+	}
+}
+
+// leak sends msg to v1 clients and event to v2 clients, unless a leak with
+// the same key has already been sent.
+func (s *IPSender) leak(key string, msg any, event *leakEvent) {
+	if s.version == PROTOCOL_V1 {
+		s.Send(key, msg)
+		return
+	}
+	event.Type = MESSAGE_LEAK
+	event.Test = s.test
+	event.Timestamp = time.Now().UTC()
+	s.Send(key, event)
+}
+
+func (s *IPSender) SendPeer(infoHash bittorrent.InfoHash, p bittorrent.Peer) {
+	ip := p.IP.String()
+	key := ip
+	if s.version != PROTOCOL_V1 {
+		// v2 reports every protocol through which the client leaked
+		key = p.Protocol + " " + ip
+	}
+	metadata := map[string]any{"request": p.Request}
+	if p.PeerID != "" {
+		metadata["peer_id"] = hex.EncodeToString([]byte(p.PeerID))
+	}
+	if p.Protocol == bittorrent.PROTOCOL_PEER_WIRE {
+		metadata["reserved"] = hex.EncodeToString(p.Reserved[:])
+	}
+	if client := p.ClientName(); client != "" {
+		metadata["client"] = client
+	}
+	if p.Key != "" {
+		metadata["key"] = p.Key
+	}
+	if p.Event != "" {
+		metadata["event"] = p.Event
+	}
+	if p.YourIP != nil {
+		// the address of the helper as seen by the client
+		metadata["yourip"] = p.YourIP.String()
+	}
+	if p.ListenPort != 0 {
+		metadata["listen_port"] = p.ListenPort
+	}
+	if p.URLData != "" {
+		metadata["url_data"] = p.URLData
+	}
+	if p.Candidate != "" {
+		metadata["candidate"] = p.Candidate
+	}
+	s.leak(key, ip, &leakEvent{
+		IP:       ip,
+		Port:     p.Port,
+		Protocol: p.Protocol,
+		InfoHash: hex.EncodeToString(infoHash[:]),
+		Metadata: metadata,
+	})
+}
+
+func (s *IPSender) SendDNSQuery(q dns.Query) {
+	ip := q.IP.String()
+	key := ip
+	event := &leakEvent{
+		IP:        ip,
+		Port:      q.Port,
+		Protocol:  q.Transport,
+		Subdomain: q.Subdomain,
+		Metadata:  map[string]any{"qtype": q.Type},
+	}
+	if ecs := q.ClientSubnet; ecs != nil {
+		event.Metadata["ecs"] = &dnsClientSubnet{
+			Family:  ecs.Family,
+			Prefix:  ecs.Prefix,
+			Address: ecs.Address.String(),
+		}
+	}
+	if s.version != PROTOCOL_V1 {
+		// v2 reports every transport and client subnet through which the
+		// resolver leaked
+		key = q.Transport + " " + ip
+		if ecs := q.ClientSubnet; ecs != nil {
+			key += " " + ecs.Address.String() + "/" + strconv.Itoa(int(ecs.Prefix))
+		}
+	}
+	s.leak(key, ip, event)
+}
+
+func (s *IPSender) SendEgress(r *http.Request, subdomain string) {
+	addr, port := clientAddr(r)
+	if addr == nil {
+		log.Println(WS_LOG_TAG, "invalid remote address:", r.RemoteAddr)
+		return
+	}
+	ip := addr.String()
+	event := &leakEvent{IP: ip, Port: port, Protocol: PROTOCOL_HTTP, Subdomain: subdomain}
+	if ua := r.UserAgent(); ua != "" {
+		event.Metadata = map[string]any{"user_agent": ua}
+	}
+	s.leak("egress "+ip, ip, event)
+}
+
+// SendBinding reports the reflexive address of a STUN or TURN request.
+func (s *IPSender) SendBinding(b stun.Binding) {
+	ip := b.IP.String()
+	key := ip
+	event := &leakEvent{IP: ip, Port: b.Port, Protocol: b.Transport, Metadata: map[string]any{}}
+	if s.version != PROTOCOL_V1 {
+		// v2 reports every transport through which the browser reached the
+		// helper
+		key = b.Transport + " " + ip
+	}
+	if b.Relay {
+		key = "turn " + key
+		event.Metadata["relay"] = true
+	}
+	if b.Software != "" {
+		event.Metadata["software"] = b.Software
+	}
+	s.leak(key, ip, event)
+}
+
+// OnClose registers f to be called when the sender stops, either on timeout
+// or because the websocket connection was closed.
+func (s *IPSender) OnClose(f func()) {
+	if s.root != nil {
+		s.root.OnClose(f)
+		return
+	}
+	s.cleanups = append(s.cleanups, f)
+}
+
+func (s *IPSender) close() {
+	for _, f := range s.cleanups {
+		f()
+	}
+}
+
+func (s *IPSender) write(msg any) error {
+	if str, ok := msg.(string); ok {
+		return s.ws.Write(s.ctx, websocket.MessageText, []byte(str))
+	}
+	return wsjson.Write(s.ctx, s.ws, msg)
+}
+
+// WriteParams sends the parameters of the test, wrapped in a params message
+// for v2 clients. On failure, the connection is closed and the sender must
+// not be started.
+func (s *IPSender) WriteParams(params any) error {
+	msg := params
+	if s.version != PROTOCOL_V1 {
+		msg = paramsMessage{Type: MESSAGE_PARAMS, Test: s.test, Params: params}
+	}
+	err := s.write(msg)
+	if err != nil {
+		log.Println(WS_LOG_TAG, "failed to send", s.test, "params:", err.Error())
+		s.close()
+		s.ws.CloseNow()
+	}
+	return err
+}
+
+// closeWithError closes ws with reason. v2 clients first receive an error
+// message with code.
+func closeWithError(ctx context.Context, ws *websocket.Conn, version int, code string, reason string) {
+	if version != PROTOCOL_V1 {
+		msg := errorMessage{Type: MESSAGE_ERROR, Code: code, Message: reason}
+		if err := wsjson.Write(ctx, ws, msg); err != nil {
+			log.Println(WS_LOG_TAG, "failed to send error:", err.Error())
+		}
+	}
+	ws.Close(websocket.StatusInternalError, reason)
+}
+
 func (s *IPSender) Start() {
-	go func() {
-		time.Sleep(s.timeout)
-		s.ch <- nil
-	}()
-	ipSet := make(map[string]struct{})
+	timeout := time.After(s.timeout)
+	sent := make(map[string]struct{})
+	// counts of the leaks sent, by test
+	dones := make(map[string]*doneMessage)
 	for {
-		ip := <-s.ch
-		if ip == nil { // timeout
+		select {
+		case <-s.ctx.Done(): // websocket connection closed by the client
+			s.close()
+			return
+		case <-timeout:
+			s.finish(dones)
+			s.close()
 			s.ws.Close(websocket.StatusNormalClosure, "")
-			break
-		} else {
-			ipStr := ip.String()
-			if _, ok := ipSet[ipStr]; !ok {
-				ipSet[ipStr] = struct{}{}
-				if err := s.ws.Write(s.ctx, websocket.MessageText, []byte(ipStr)); err != nil {
+			return
+		case m := <-s.ch:
+			if _, ok := sent[m.key]; !ok {
+				sent[m.key] = struct{}{}
+				if err := s.write(m.msg); err != nil {
 					log.Println(WS_LOG_TAG, "failed to send IP:", err.Error())
+					continue
+				}
+				if event, ok := m.msg.(*leakEvent); ok {
+					done, ok := dones[event.Test]
+					if !ok {
+						done = &doneMessage{Type: MESSAGE_DONE, Test: event.Test, IPs: []string{}}
+						dones[event.Test] = done
+					}
+					done.Leaks++
+					if !slices.Contains(done.IPs, event.IP) {
+						done.IPs = append(done.IPs, event.IP)
+					}
 				}
 			}
 		}
 	}
 }
 
-func dnsLeakTest(ws *websocket.Conn) {
-	random := utils.RandomBytes(4 * DNS_LEAK_TESTS_NUMBER)
-	ctx := context.Background()
-	ws.CloseRead(ctx)
+// finish sends the result of Summary to v1 clients. v2 clients receive a
+// done message for each test of the sender, followed by the verdict if
+// ClientIP is set.
+func (s *IPSender) finish(dones map[string]*doneMessage) {
+	var messages []any
+	if s.version == PROTOCOL_V1 {
+		if s.Summary != nil {
+			messages = append(messages, s.Summary())
+		}
+	} else {
+		senders := s.subs
+		if len(senders) == 0 {
+			senders = []*IPSender{s}
+		}
+		var results []doneMessage
+		for _, sender := range senders {
+			results = append(results, sender.done(dones))
+			messages = append(messages, results[len(results)-1])
+		}
+		if s.ClientIP != "" {
+			messages = append(messages, newVerdict(s.ClientIP, results))
+		}
+	}
+	for _, msg := range messages {
+		if err := s.write(msg); err != nil {
+			log.Println(WS_LOG_TAG, "failed to send summary:", err.Error())
+			return
+		}
+	}
+}
+
+// done returns the done message of the test of s.
+func (s *IPSender) done(dones map[string]*doneMessage) doneMessage {
+	done := doneMessage{Type: MESSAGE_DONE, Test: s.test, IPs: []string{}}
+	if d, ok := dones[s.test]; ok {
+		done = *d
+	}
+	if s.Summary != nil {
+		done.Summary = s.Summary()
+	}
+	return done
+}
+
+func dnsLeakTest(ws *websocket.Conn, r *http.Request, version int) {
+	ctx := ws.CloseRead(context.Background())
+	ipSender := NewIPSender(ws, ctx, TEST_DNS, version, conf.DNS.Timeout)
+	ipSender.ClientIP = clientIP(r)
+	params := setupDNSLeakTest(ipSender)
+	if err := ipSender.WriteParams(params); err != nil {
+		return
+	}
+	go ipSender.Start()
+}
+
+// setupDNSLeakTest registers the subdomains of a DNS leak test, whose leaks
+// are reported through ipSender. v1 clients only receive the base domain and
+// the subdomains.
+func setupDNSLeakTest(ipSender *IPSender) any {
 	params := dnsLeakTestParams{
 		Base:       conf.DNS.Domain,
 		Subdomains: make([]string, 0, DNS_LEAK_TESTS_NUMBER),
+		Resolvable: conf.DNS.Answer == dns.ANSWER_ADDRESS,
+	}
+	if ipSender.version == PROTOCOL_V1 {
+		for range DNS_LEAK_TESTS_NUMBER {
+			token := registerToken(ipSender, func(token string) (uint64, bool) {
+				return dnsServer.RegisterCallback(token, ipSender.SendDNSQuery)
+			})
+			params.Subdomains = append(params.Subdomains, token)
+		}
+		return dnsLeakTestParamsV1{Base: params.Base, Subdomains: params.Subdomains}
+	}
+	profile := new(dns.ResolverProfile)
+	var minimisation *dns.QnameMinimisation
+	ipSender.Summary = func() any {
+		return dnsSummary{
+			Resolver:          profile.Fingerprint(),
+			QnameMinimisation: minimisation.Result(),
+		}
+	}
+	callback := func(q dns.Query) {
+		profile.Add(q)
+		ipSender.SendDNSQuery(q)
+	}
+	minimisationToken := registerToken(ipSender, func(token string) (uint64, bool) {
+		return dnsServer.RegisterQnameMinimisationProbe(token, func(q dns.Query) {
+			minimisation.Add(q)
+			callback(q)
+		})
+	})
+	params.Minimisation = randomToken() + "." + minimisationToken
+	params.Echo = registerEcho(ipSender)
+	minimisation = dns.NewQnameMinimisation(params.Minimisation)
+	for range DNS_LEAK_TESTS_NUMBER {
+		token := registerToken(ipSender, func(token string) (uint64, bool) {
+			return dnsServer.RegisterCallback(token, callback)
+		})
+		params.Subdomains = append(params.Subdomains, token)
+		if params.Resolvable {
+			httpProbes.Store(token, func(r *http.Request) {
+				ipSender.SendEgress(r, token)
+			})
+			ipSender.OnClose(func() { httpProbes.Delete(token) })
+		}
+	}
+	return params
+}
+
+func randomToken() string {
+	return dns.EncodeToken(utils.RandomBytes(conf.DNS.TokenSize))
+}
+
+// registerToken registers a random token with register, drawing a new one
+// in the unlikely event of a collision. The token is unregistered when
+// ipSender stops.
+func registerToken(ipSender *IPSender, register func(token string) (id uint64, inUse bool)) string {
+	for {
+		token := randomToken()
+		id, inUse := register(token)
+		if !inUse {
+			ipSender.OnClose(func() { dnsServer.Unregister(token, id) })
+			return token
+		}
+		dnsServer.Unregister(token, id)
+	}
+}
+
+// httpProbe handles requests sent to a subdomain of conf.DNS.Domain, which
+// succeed only if the subdomain could be resolved.
+func httpProbe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if token, _, ok := dns.SplitName(strings.ToLower(host), conf.DNS.Domain); ok {
+		if f, ok := httpProbes.Load(token); ok {
+			f.(func(*http.Request))(r)
+		}
 	}
-	ipSender := NewIPSender(ws, ctx, conf.DNS.Timeout)
-	for i := 0; i < DNS_LEAK_TESTS_NUMBER; i++ {
-		s := binary.LittleEndian.Uint32(random[i : i+4])
-		params.Subdomains = append(params.Subdomains, strconv.FormatUint(uint64(s), 10))
-		dnsServer.RegisterCallback(s, ipSender.Callback)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func dnssecTest(ws *websocket.Conn, _ *http.Request, version int) {
+	ctx := ws.CloseRead(context.Background())
+	if conf.DNS.DNSSEC.Key == "" {
+		closeWithError(ctx, ws, version, ERROR_DNSSEC_DISABLED, "DNSSEC is not enabled")
+		return
+	}
+	ipSender := NewIPSender(ws, ctx, TEST_DNSSEC, version, conf.DNS.Timeout)
+	signed := registerToken(ipSender, func(token string) (uint64, bool) {
+		return dnsServer.RegisterDNSSECProbe(token, false, ipSender.SendDNSQuery)
+	})
+	bogus := registerToken(ipSender, func(token string) (uint64, bool) {
+		return dnsServer.RegisterDNSSECProbe(token, true, ipSender.SendDNSQuery)
+	})
+	params := dnssecTestParams{
+		Base:   conf.DNS.Domain,
+		Signed: signed,
+		Bogus:  bogus,
+	}
+	var signedReached, bogusReached atomic.Bool
+	httpProbes.Store(signed, func(*http.Request) { signedReached.Store(true) })
+	httpProbes.Store(bogus, func(*http.Request) { bogusReached.Store(true) })
+	ipSender.OnClose(func() {
+		httpProbes.Delete(signed)
+		httpProbes.Delete(bogus)
+	})
+	ipSender.Summary = func() any {
+		summary := dnssecSummary{
+			SignedReached: signedReached.Load(),
+			BogusReached:  bogusReached.Load(),
+		}
+		if summary.SignedReached {
+			validating := !summary.BogusReached
+			summary.Validating = &validating
+		}
+		return summary
 	}
-	if err := wsjson.Write(ctx, ws, params); err != nil {
-		log.Println(WS_LOG_TAG, "failed to send DNS params:", err.Error())
-		ws.CloseNow()
+	if err := ipSender.WriteParams(params); err != nil {
 		return
 	}
 	go ipSender.Start()
 }
 
-func bittorrentLeakTest(ws *websocket.Conn) {
-	infoHash := bittorrent.InfoHash(utils.RandomBytes(20))
-	ctx := context.Background()
-	ws.CloseRead(ctx)
-	ipSender := NewIPSender(ws, ctx, conf.BitTorrent.Timeout)
-	bittorrentTracker.RegisterCallback(infoHash, ipSender.Callback)
-	magnetLink := "magnet:?xt=urn:btih:" + hex.EncodeToString(infoHash[:]) + "&tr=udp://" + conf.Host + ":" + strconv.FormatInt(int64(bittorrentTrackerPort), 10)
-	if err := ws.Write(ctx, websocket.MessageText, []byte(magnetLink)); err != nil {
-		log.Println(WS_LOG_TAG, "failed to send magnet link:", err)
-		ws.CloseNow()
+func bittorrentLeakTest(ws *websocket.Conn, r *http.Request, version int) {
+	ctx := ws.CloseRead(context.Background())
+	ipSender := NewIPSender(ws, ctx, TEST_BITTORRENT, version, conf.BitTorrent.Timeout)
+	ipSender.ClientIP = clientIP(r)
+	params := setupBittorrentLeakTest(ipSender)
+	if err := ipSender.WriteParams(params); err != nil {
 		return
 	}
 	go ipSender.Start()
 }
 
+// setupBittorrentLeakTest registers the info hash of a BitTorrent leak test,
+// whose leaks are reported through ipSender. v1 clients only receive the
+// magnet link.
+func setupBittorrentLeakTest(ipSender *IPSender) any {
+	var infoHash bittorrent.InfoHash
+	for {
+		infoHash = bittorrent.InfoHash(utils.RandomBytes(len(infoHash)))
+		id, inUse := bittorrentTracker.RegisterCallback(infoHash, func(p bittorrent.Peer) {
+			ipSender.SendPeer(infoHash, p)
+		})
+		if !inUse {
+			ipSender.OnClose(func() { bittorrentTracker.Unregister(infoHash, id) })
+			break
+		}
+		bittorrentTracker.Unregister(infoHash, id)
+	}
+	// per-test path of the UDP tracker URLs, sent back as URL data (BEP 41)
+	// by the clients supporting it. v1 magnet links don't carry it.
+	trackerPath := ""
+	if ipSender.version != PROTOCOL_V1 {
+		trackerPath = "/" + randomToken()
+	}
+	magnetLink := "magnet:?xt=urn:btih:" + hex.EncodeToString(infoHash[:]) + "&tr=udp://" + conf.Host + ":" + strconv.FormatInt(int64(bittorrentTrackerPort), 10) + trackerPath
+	// trackers reachable over a single address family, so that clients
+	// leaking over both announce to both
+	for _, host := range []string{conf.IPv4Host, conf.IPv6Host} {
+		if host != "" {
+			magnetLink += "&tr=udp://" + host + ":" + strconv.Itoa(bittorrentTrackerPort) + trackerPath
+		}
+	}
+	if bittorrentHTTPTrackerPort != 0 {
+		scheme := bittorrent.PROTOCOL_HTTP
+		if conf.Websocket.TLS.Enabled() {
+			scheme = bittorrent.PROTOCOL_HTTPS
+		}
+		magnetLink += "&tr=" + scheme + "://" + conf.Host + ":" + strconv.Itoa(bittorrentHTTPTrackerPort) + "/announce"
+	}
+	// browser clients only reach websocket trackers
+	if conf.BitTorrent.WebTorrentURL != "" {
+		magnetLink += "&tr=" + conf.BitTorrent.WebTorrentURL
+	}
+	// peer address hint, for clients connecting to the peer-wire server,
+	// which also advertises the DHT node with a PORT message
+	if bittorrentPeerPort != 0 {
+		magnetLink += "&x.pe=" + conf.Host + ":" + strconv.Itoa(bittorrentPeerPort)
+	}
+	// DHT node hint, added to their routing table by libtorrent based
+	// clients
+	if bittorrentDHTPort != 0 {
+		magnetLink += "&dht=" + conf.Host + ":" + strconv.Itoa(bittorrentDHTPort)
+	}
+	if ipSender.version == PROTOCOL_V1 {
+		return magnetLink
+	}
+	return bittorrentTestParams{Magnet: magnetLink, InfoHash: hex.EncodeToString(infoHash[:]), Echo: registerEcho(ipSender)}
+}
+
+// webrtcLeakTest gives the browser the credentials of an ICE session with the
+// helper. The connectivity checks the browser sends to the helper from each
+// of its network interfaces reveal their reflexive addresses.
+func webrtcLeakTest(ws *websocket.Conn, _ *http.Request, version int) {
+	ctx := ws.CloseRead(context.Background())
+	if stunPort == 0 {
+		closeWithError(ctx, ws, version, ERROR_WEBRTC_DISABLED, "STUN server is not enabled")
+		return
+	}
+	ipSender := NewIPSender(ws, ctx, TEST_WEBRTC, version, conf.STUN.Timeout)
+	params := setupWebrtcLeakTest(ipSender)
+	if err := ipSender.WriteParams(params); err != nil {
+		return
+	}
+	go ipSender.Start()
+}
+
+// setupWebrtcLeakTest registers the ICE session of a WebRTC leak test, whose
+// leaks are reported through ipSender. The STUN server must be enabled.
+func setupWebrtcLeakTest(ipSender *IPSender) webrtcTestParams {
+	var token string
+	for {
+		token = randomToken()
+		stunId, stunInUse := stunServer.RegisterCallback(token, ipSender.SendBinding)
+		var turnId uint64
+		turnInUse := false
+		if turnPort != 0 {
+			turnId, turnInUse = turnServer.RegisterCallback(token, ipSender.SendBinding)
+		}
+		if !stunInUse && !turnInUse {
+			ipSender.OnClose(func() {
+				stunServer.Unregister(token, stunId)
+				if turnPort != 0 {
+					turnServer.Unregister(token, turnId)
+				}
+			})
+			break
+		}
+		stunServer.Unregister(token, stunId)
+		if turnPort != 0 {
+			turnServer.Unregister(token, turnId)
+		}
+	}
+	params := webrtcTestParams{Username: token, Password: stunServer.Password(token), Echo: registerEcho(ipSender)}
+	for _, host := range []string{conf.Host, conf.IPv4Host, conf.IPv6Host} {
+		if host != "" {
+			params.URLs = append(params.URLs, "stun:"+host+":"+strconv.Itoa(stunPort))
+		}
+	}
+	if turnPort != 0 {
+		params.TURN = new(turnParams)
+		params.TURN.Username, params.TURN.Credential = turnServer.Credentials(token)
+		for _, transport := range []string{turn.TRANSPORT_UDP, turn.TRANSPORT_TCP} {
+			params.TURN.URLs = append(params.TURN.URLs, "turn:"+conf.Host+":"+strconv.Itoa(turnPort)+"?transport="+transport)
+		}
+		if turnTLSPort != 0 {
+			params.TURN.URLs = append(params.TURN.URLs, "turns:"+conf.Host+":"+strconv.Itoa(turnTLSPort)+"?transport=tcp")
+		}
+	}
+	for _, ip := range helperAddresses {
+		params.Candidates = append(params.Candidates, net.JoinHostPort(ip.String(), strconv.Itoa(stunPort)))
+	}
+	return params
+}
+
 func startWebsocketServer(addr string, tls TLSConfig, options websocket.AcceptOptions) {
-	acceptWebsocket := func(callback func(*websocket.Conn)) func(http.ResponseWriter, *http.Request) {
+	acceptWebsocket := func(callback func(*websocket.Conn, *http.Request, int), version int) func(http.ResponseWriter, *http.Request) {
 		return func(w http.ResponseWriter, r *http.Request) {
 			ws, err := websocket.Accept(w, r, &options)
 			if err != nil {
 				log.Println(WS_LOG_TAG, "failed to accept:", err.Error())
 				return
 			}
-			callback(ws)
+			callback(ws, r, version)
 		}
 	}
-	http.HandleFunc("/v1/dns", acceptWebsocket(dnsLeakTest))
-	http.HandleFunc("/v1/bittorrent", acceptWebsocket(bittorrentLeakTest))
+	for _, version := range []int{PROTOCOL_V1, PROTOCOL_V2} {
+		prefix := "/v" + strconv.Itoa(version) + "/"
+		http.HandleFunc(prefix+TEST_DNS, acceptWebsocket(dnsLeakTest, version))
+		http.HandleFunc(prefix+TEST_BITTORRENT, acceptWebsocket(bittorrentLeakTest, version))
+		http.HandleFunc(prefix+TEST_DNSSEC, acceptWebsocket(dnssecTest, version))
+		http.HandleFunc(prefix+TEST_WEBRTC, acceptWebsocket(webrtcLeakTest, version))
+		http.HandleFunc(prefix+"probe", httpProbe)
+	}
+	http.HandleFunc("/v2/"+TEST_SESSION, acceptWebsocket(sessionTest, PROTOCOL_V2))
+	// only v2 tests hand out echo tokens
+	http.HandleFunc("/v2/echo/{token}", httpEcho)
 
 	var err error
-	if tls.Cert == "" && tls.Key == "" {
+	if !tls.Enabled() {
 		err = http.ListenAndServe(addr, nil)
 	} else {
 		err = http.ListenAndServeTLS(addr, tls.Cert, tls.Key, nil)
@@ -3,14 +3,23 @@ package main
 import (
 	"context"
 	"encoding/hex"
+	"encoding/json"
+	"maps"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 	"zeroleaks/bittorrent"
+	"zeroleaks/dns"
+	"zeroleaks/stun"
+	"zeroleaks/turn"
 	"zeroleaks/utils"
 
 	"github.com/coder/websocket"
@@ -20,12 +29,105 @@ import (
 const addr = "127.0.0.1:38080"
 const timeout = 100 * time.Millisecond
 
-type MockLogger[T comparable] struct {
-	callbacks map[T]func(net.IP)
+type MockLogger[T comparable, E any] struct {
+	mutex     sync.Mutex
+	callbacks map[T]func(E)
 }
 
-func (l *MockLogger[T]) RegisterCallback(k T, f func(net.IP)) {
+// RegisterCallback only supports one observer per key.
+func (l *MockLogger[T, E]) RegisterCallback(k T, f func(E)) (uint64, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.callbacks[k]; ok {
+		return 0, true
+	}
 	l.callbacks[k] = f
+	return 1, false
+}
+
+func (l *MockLogger[T, E]) Unregister(k T, id uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if id == 1 {
+		delete(l.callbacks, k)
+	}
+}
+
+func (l *MockLogger[T, E]) callback(k T) (func(E), bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	f, ok := l.callbacks[k]
+	return f, ok
+}
+
+func (l *MockLogger[T, E]) len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.callbacks)
+}
+
+type MockDNSLogger struct {
+	MockLogger[string, dns.Query]
+	bogus map[string]bool
+}
+
+func (l *MockDNSLogger) RegisterDNSSECProbe(k string, bogus bool, f func(dns.Query)) (uint64, bool) {
+	id, inUse := l.RegisterCallback(k, f)
+	if !inUse {
+		l.bogus[k] = bogus
+	}
+	return id, inUse
+}
+
+func (l *MockDNSLogger) RegisterQnameMinimisationProbe(k string, f func(dns.Query)) (uint64, bool) {
+	return l.RegisterCallback(k, f)
+}
+
+func newMockDNSLogger() *MockDNSLogger {
+	return &MockDNSLogger{
+		MockLogger: MockLogger[string, dns.Query]{
+			callbacks: make(map[string]func(dns.Query)),
+		},
+		bogus: make(map[string]bool),
+	}
+}
+
+func newMockTracker() *MockLogger[bittorrent.InfoHash, bittorrent.Peer] {
+	return &MockLogger[bittorrent.InfoHash, bittorrent.Peer]{
+		callbacks: make(map[bittorrent.InfoHash]func(bittorrent.Peer)),
+	}
+}
+
+type MockSTUNLogger struct {
+	MockLogger[string, stun.Binding]
+}
+
+func (l *MockSTUNLogger) Password(k string) string {
+	return "password of " + k
+}
+
+func newMockSTUNLogger() *MockSTUNLogger {
+	return &MockSTUNLogger{
+		MockLogger: MockLogger[string, stun.Binding]{
+			callbacks: make(map[string]func(stun.Binding)),
+		},
+	}
+}
+
+type MockTURNLogger struct {
+	MockLogger[string, stun.Binding]
+}
+
+func (l *MockTURNLogger) Credentials(k string) (string, string) {
+	return "1700000000:" + k, "credential of " + k
+}
+
+func newMockTURNLogger() *MockTURNLogger {
+	return &MockTURNLogger{
+		MockLogger: MockLogger[string, stun.Binding]{
+			callbacks: make(map[string]func(stun.Binding)),
+		},
+	}
 }
 
 type WebsocketClient struct {
@@ -34,14 +136,19 @@ type WebsocketClient struct {
 }
 
 func TestMain(m *testing.M) {
+	conf.DNS.TokenSize = dns.MIN_TOKEN_SIZE
 	go startWebsocketServer(addr, TLSConfig{}, websocket.AcceptOptions{})
 	time.Sleep(10 * time.Millisecond) // let the websocket server start
 	os.Exit(m.Run())
 }
 
 func wsConnect(endpoint string, t *testing.T) WebsocketClient {
+	return wsConnectVersion(PROTOCOL_V1, endpoint, t)
+}
+
+func wsConnectVersion(version int, endpoint string, t *testing.T) WebsocketClient {
 	ctx := context.Background()
-	ws, _, err := websocket.Dial(ctx, "ws://"+addr+"/v1/"+endpoint, nil)
+	ws, _, err := websocket.Dial(ctx, "ws://"+addr+"/v"+strconv.Itoa(version)+"/"+endpoint, nil)
 	if err != nil {
 		utils.TFatalf(t, "Cannot establish websocket connection: %s", err)
 	}
@@ -97,51 +204,193 @@ func (w *WebsocketClient) assertEnd(timeout time.Duration, t *testing.T) {
 func TestDnsLeak(t *testing.T) {
 	conf.DNS.Domain = "test"
 	conf.DNS.Timeout = timeout
-	dnsServer = &MockLogger[uint32]{
-		callbacks: make(map[uint32]func(net.IP)),
-	}
+	conf.DNS.Answer = dns.ANSWER_ADDRESS
+	defer func() { conf.DNS.Answer = dns.ANSWER_NXDOMAIN }()
+	dnsServer = newMockDNSLogger()
 	ws := wsConnect("dns", t)
-	params := new(dnsLeakTestParams)
-	ws.readJson(params, t)
+	var fields map[string]json.RawMessage
+	ws.readJson(&fields, t)
+	if len(fields) != 2 {
+		utils.TErrorf(t, "Unexpected v1 params: %v", slices.Collect(maps.Keys(fields)))
+	}
+	params := new(dnsLeakTestParamsV1)
+	if err := json.Unmarshal(fields["base"], &params.Base); err != nil {
+		utils.TFatalf(t, "Invalid base domain: %s", err)
+	}
+	if err := json.Unmarshal(fields["subdomains"], &params.Subdomains); err != nil {
+		utils.TFatalf(t, "Invalid subdomains: %s", err)
+	}
 	if params.Base != conf.DNS.Domain {
 		utils.TErrorf(t, "Invalid base domain. Got %s, expected %s", params.Base, conf.DNS.Domain)
 	}
 	if len(params.Subdomains) != DNS_LEAK_TESTS_NUMBER {
 		utils.TErrorf(t, "Incorrect number of subdomains received. Got %d, expected %d", len(params.Subdomains), DNS_LEAK_TESTS_NUMBER)
 	}
+	for _, s := range params.Subdomains {
+		if len(s) < 26 { // 128 bits in base32
+			utils.TErrorf(t, "Subdomain token too short: %s", s)
+		}
+	}
 	ip1 := utils.RandomIPv4()
 	ip2 := utils.RandomIPv4()
 	ip3 := utils.RandomIPv4()
 	ip4 := utils.RandomIPv6()
 	ip5 := utils.RandomIPv4()
 	ip6 := utils.RandomIPv6()
-	ips := []net.IP{ip1, ip1, ip2, ip3, ip1, ip4, ip5, ip6, ip1, ip3, ip6}
+	ecs := &dns.ClientSubnet{Family: 1, Prefix: 24, Address: net.IPv4(192, 0, 2, 0)}
+	udp := dns.TRANSPORT_UDP
+	tcp := dns.TRANSPORT_TCP
+	queries := []dns.Query{
+		{IP: ip1, Transport: udp},
+		{IP: ip1, Transport: udp},
+		{IP: ip2, Transport: udp},
+		{IP: ip1, Transport: tcp},
+		{IP: ip3, Transport: udp},
+		{IP: ip1, Transport: udp},
+		{IP: ip4, Transport: tcp},
+		{IP: ip5, Transport: udp},
+		{IP: ip6, Transport: udp},
+		{IP: ip1, Transport: tcp},
+		{IP: ip3, Transport: udp},
+		{IP: ip6, Transport: udp},
+		{IP: ip5, Transport: udp, ClientSubnet: ecs},
+		{IP: ip5, Transport: udp, ClientSubnet: ecs},
+	}
 	go func() {
-		for _, ip := range ips {
+		for _, q := range queries {
 			s := params.Subdomains[rand.Intn(len(params.Subdomains))]
-			k, err := strconv.ParseUint(s, 10, 32)
-			if err != nil {
+			f, ok := dnsServer.(*MockDNSLogger).callback(s)
+			if !ok {
 				utils.TErrorf(t, "Invalid subdomain received: %s", s)
+				return
 			}
-			dnsServer.(*MockLogger[uint32]).callbacks[uint32(k)](ip)
+			f(q)
 		}
 	}()
+	// v1 sends each resolver once as a bare address, whatever the transport
+	// or client subnet, and no summary
 	ws.readAssertEqualsIP(ip1, t)
 	ws.readAssertEqualsIP(ip2, t)
 	ws.readAssertEqualsIP(ip3, t)
 	ws.readAssertEqualsIP(ip4, t)
 	ws.readAssertEqualsIP(ip5, t)
 	ws.readAssertEqualsIP(ip6, t)
+	sendHttpProbe(params.Subdomains[0]+"."+params.Base, t) // not reported
+	ws.assertEnd(conf.DNS.Timeout, t)
+	if n := dnsServer.(*MockDNSLogger).len(); n != 0 {
+		utils.TErrorf(t, "%d subdomains still registered after the end of the test", n)
+	}
+}
+
+func TestUnregisterOnClose(t *testing.T) {
+	conf.DNS.Domain = "test"
+	conf.DNS.Timeout = time.Minute
+	logger := newMockDNSLogger()
+	dnsServer = logger
+	ws := wsConnect("dns", t)
+	ws.readJson(new(dnsLeakTestParams), t)
+	if logger.len() == 0 {
+		utils.TFatalf(t, "No subdomain registered")
+	}
+	if err := ws.ws.Close(websocket.StatusNormalClosure, ""); err != nil {
+		utils.TFatalf(t, "Failed to close websocket connection: %s", err)
+	}
+	time.Sleep(20 * time.Millisecond) // let the server handle the closure
+	if n := logger.len(); n != 0 {
+		utils.TErrorf(t, "%d subdomains still registered after the websocket was closed", n)
+	}
+}
+
+func sendHttpProbe(host string, t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/v1/probe", nil)
+	if err != nil {
+		utils.TFatalf(t, "Failed to create probe request: %s", err)
+	}
+	req.Host = host
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		utils.TFatalf(t, "Probe request failed: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		utils.TErrorf(t, "Invalid probe response status: %d", res.StatusCode)
+	}
+}
+
+func TestDnsLeakEgress(t *testing.T) {
+	conf.DNS.Domain = "test"
+	conf.DNS.Timeout = timeout
+	conf.DNS.Answer = dns.ANSWER_ADDRESS
+	defer func() { conf.DNS.Answer = dns.ANSWER_NXDOMAIN }()
+	dnsServer = newMockDNSLogger()
+	ws := wsConnectVersion(PROTOCOL_V2, "dns", t)
+	params := struct {
+		paramsMessage
+		Params dnsLeakTestParams `json:"params"`
+	}{}
+	ws.readJson(&params, t)
+	if !params.Params.Resolvable {
+		utils.TErrorf(t, "Subdomains not announced as resolvable")
+	}
+	base, subdomains := params.Params.Base, params.Params.Subdomains
+	sendHttpProbe("unknown."+base, t) // not reported
+	sendHttpProbe(subdomains[0]+"."+base, t)
+	sendHttpProbe(subdomains[1]+"."+base, t) // same egress IP, not reported
+	event := new(leakEvent)
+	ws.readJson(event, t)
+	if event.Type != MESSAGE_LEAK || event.IP != "127.0.0.1" || event.Protocol != PROTOCOL_HTTP || event.Subdomain != subdomains[0] {
+		utils.TErrorf(t, "Invalid egress leak received: %+v", event)
+	}
+	done := new(doneMessage)
+	ws.readJson(done, t)
+	if done.Type != MESSAGE_DONE || done.Leaks != 1 {
+		utils.TErrorf(t, "Invalid done message: %+v", done)
+	}
+	ws.readVerdict(t)
 	ws.assertEnd(conf.DNS.Timeout, t)
 }
 
+func TestDnssec(t *testing.T) {
+	conf.DNS.Domain = "test"
+	conf.DNS.Timeout = timeout
+	key := conf.DNS.DNSSEC.Key
+	conf.DNS.DNSSEC.Key = "test"
+	defer func() { conf.DNS.DNSSEC.Key = key }()
+	logger := newMockDNSLogger()
+	dnsServer = logger
+	for _, bogusReached := range []bool{false, true} {
+		ws := wsConnect("dnssec", t)
+		params := new(dnssecTestParams)
+		ws.readJson(params, t)
+		for _, s := range []string{params.Signed, params.Bogus} {
+			if _, ok := logger.callback(s); !ok {
+				utils.TFatalf(t, "Invalid subdomain received: %s", s)
+			}
+			if logger.bogus[s] != (s == params.Bogus) {
+				utils.TErrorf(t, "Subdomain %s registered with the wrong signature mode", s)
+			}
+		}
+		sendHttpProbe(params.Signed+"."+params.Base, t)
+		if bogusReached {
+			sendHttpProbe(params.Bogus+"."+params.Base+":80", t)
+		}
+		summary := new(dnssecSummary)
+		ws.readJson(summary, t)
+		if !summary.SignedReached || summary.BogusReached != bogusReached {
+			utils.TErrorf(t, "Invalid probes status: %+v", summary)
+		}
+		if summary.Validating == nil || *summary.Validating == bogusReached {
+			utils.TErrorf(t, "Invalid DNSSEC validation result: %v", summary.Validating)
+		}
+		ws.assertEnd(conf.DNS.Timeout, t)
+	}
+}
+
 func TestBittorrentLeak(t *testing.T) {
 	conf.BitTorrent.Timeout = timeout
 	conf.Host = "test"
 	bittorrentTrackerPort = 1337
-	bittorrentTracker = &MockLogger[bittorrent.InfoHash]{
-		callbacks: make(map[bittorrent.InfoHash]func(net.IP)),
-	}
+	bittorrentTracker = newMockTracker()
 	ws := wsConnect("bittorrent", t)
 	magnetLink := ws.readString(t)
 	re := regexp.MustCompile(`^magnet:\?xt=urn:btih:([0-9a-f]{40})&tr=udp://test:1337$`)
@@ -159,7 +408,8 @@ func TestBittorrentLeak(t *testing.T) {
 	ips := []net.IP{ip1, ip2, ip2, ip1, ip3}
 	go func() {
 		for _, ip := range ips {
-			bittorrentTracker.(*MockLogger[bittorrent.InfoHash]).callbacks[bittorrent.InfoHash(infoHash)](ip)
+			f, _ := bittorrentTracker.(*MockLogger[bittorrent.InfoHash, bittorrent.Peer]).callback(bittorrent.InfoHash(infoHash))
+			f(bittorrent.Peer{IP: ip, Port: 6881, Protocol: bittorrent.PROTOCOL_UDP})
 		}
 	}()
 	ws.readAssertEqualsIP(ip1, t)
@@ -167,3 +417,288 @@ func TestBittorrentLeak(t *testing.T) {
 	ws.readAssertEqualsIP(ip3, t)
 	ws.assertEnd(conf.BitTorrent.Timeout, t)
 }
+
+func (w *WebsocketClient) readAssertEqualsLeakEvent(expected leakEvent, t *testing.T) *leakEvent {
+	event := new(leakEvent)
+	w.readJson(event, t)
+	if event.Type != MESSAGE_LEAK || event.Test != expected.Test {
+		utils.TErrorf(t, "Invalid leak event: got %s/%s, expected %s/%s", event.Type, event.Test, MESSAGE_LEAK, expected.Test)
+	}
+	if !net.ParseIP(event.IP).Equal(net.ParseIP(expected.IP)) || event.Port != expected.Port || event.Protocol != expected.Protocol {
+		utils.TErrorf(t, "Invalid leak source: got %s:%d/%s, expected %s:%d/%s", event.IP, event.Port, event.Protocol, expected.IP, expected.Port, expected.Protocol)
+	}
+	if event.Subdomain != expected.Subdomain || event.InfoHash != expected.InfoHash {
+		utils.TErrorf(t, "Invalid leak target: got %q %q, expected %q %q", event.Subdomain, event.InfoHash, expected.Subdomain, expected.InfoHash)
+	}
+	if time.Since(event.Timestamp) > time.Second {
+		utils.TErrorf(t, "Invalid leak timestamp: %s", event.Timestamp)
+	}
+	return event
+}
+
+// readVerdict reads the verdict of a test run from 127.0.0.1.
+func (w *WebsocketClient) readVerdict(t *testing.T) *verdictMessage {
+	verdict := new(verdictMessage)
+	w.readJson(verdict, t)
+	if verdict.Type != MESSAGE_VERDICT || verdict.ClientIP != "127.0.0.1" {
+		utils.TErrorf(t, "Invalid verdict: %+v", verdict)
+	}
+	return verdict
+}
+
+func TestDnsLeakV2(t *testing.T) {
+	conf.DNS.Domain = "test"
+	conf.DNS.Timeout = timeout
+	logger := newMockDNSLogger()
+	dnsServer = logger
+	ws := wsConnectVersion(PROTOCOL_V2, "dns", t)
+	params := struct {
+		paramsMessage
+		Params dnsLeakTestParams `json:"params"`
+	}{}
+	ws.readJson(&params, t)
+	if params.Type != MESSAGE_PARAMS || params.Test != TEST_DNS {
+		utils.TErrorf(t, "Invalid params message: %s/%s", params.Type, params.Test)
+	}
+	if len(params.Params.Subdomains) != DNS_LEAK_TESTS_NUMBER {
+		utils.TFatalf(t, "Incorrect number of subdomains received. Got %d, expected %d", len(params.Params.Subdomains), DNS_LEAK_TESTS_NUMBER)
+	}
+	ip1 := utils.RandomIPv4()
+	ip2 := utils.RandomIPv6()
+	subdomain := params.Params.Subdomains[0]
+	f, ok := logger.callback(subdomain)
+	if !ok {
+		utils.TFatalf(t, "Invalid subdomain received: %s", subdomain)
+	}
+	ecs := &dns.ClientSubnet{Family: 1, Prefix: 24, Address: net.IPv4(192, 0, 2, 0)}
+	go func() {
+		f(dns.Query{IP: ip1, Port: 1234, Transport: dns.TRANSPORT_UDP, Subdomain: subdomain, Type: 1})
+		f(dns.Query{IP: ip1, Port: 1235, Transport: dns.TRANSPORT_UDP, Subdomain: subdomain, Type: 1})
+		f(dns.Query{IP: ip2, Port: 53, Transport: dns.TRANSPORT_TCP, Subdomain: subdomain, Type: 28, ClientSubnet: ecs})
+	}()
+	event := ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_DNS, IP: ip1.String(), Port: 1234, Protocol: dns.TRANSPORT_UDP, Subdomain: subdomain}, t)
+	if event.Metadata["qtype"] != float64(1) {
+		utils.TErrorf(t, "Invalid query type in metadata: %v", event.Metadata)
+	}
+	event = ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_DNS, IP: ip2.String(), Port: 53, Protocol: dns.TRANSPORT_TCP, Subdomain: subdomain}, t)
+	if ecs, ok := event.Metadata["ecs"].(map[string]any); !ok || ecs["address"] != "192.0.2.0" {
+		utils.TErrorf(t, "Invalid client subnet in metadata: %v", event.Metadata)
+	}
+	labels := strings.Split(params.Params.Minimisation, ".")
+	if len(labels) != 2 {
+		utils.TFatalf(t, "Invalid minimisation subdomain: %s", params.Params.Minimisation)
+	}
+	minimisationCallback, ok := logger.callback(labels[1])
+	if !ok {
+		utils.TFatalf(t, "Minimisation subdomain not registered: %s", params.Params.Minimisation)
+	}
+	minimisationCallback(dns.Query{IP: ip1, Transport: dns.TRANSPORT_UDP, Subdomain: labels[1]})
+	minimisationCallback(dns.Query{IP: ip1, Transport: dns.TRANSPORT_UDP, Subdomain: params.Params.Minimisation})
+	done := struct {
+		doneMessage
+		Summary dnsSummary `json:"summary"`
+	}{}
+	ws.readJson(&done, t)
+	if done.Type != MESSAGE_DONE || done.Test != TEST_DNS {
+		utils.TErrorf(t, "Invalid done message: %s/%s", done.Type, done.Test)
+	}
+	if done.Leaks != 2 || len(done.IPs) != 2 || done.IPs[0] != ip1.String() || done.IPs[1] != ip2.String() {
+		utils.TErrorf(t, "Invalid done message leaks: %d %v", done.Leaks, done.IPs)
+	}
+	if done.Summary.Resolver.Queries != 5 {
+		utils.TErrorf(t, "Invalid number of queries in resolver fingerprint: got %d, expected 5", done.Summary.Resolver.Queries)
+	}
+	if done.Summary.QnameMinimisation == nil || !*done.Summary.QnameMinimisation {
+		utils.TErrorf(t, "QNAME minimisation not detected")
+	}
+	if verdict := ws.readVerdict(t); !verdict.Leaked || len(verdict.Addresses) != 2 || !slices.Contains(verdict.Addresses[1].Classes, CLASS_FAMILY_MISMATCH) {
+		utils.TErrorf(t, "Invalid verdict addresses: %+v", verdict.Addresses)
+	}
+	ws.assertEnd(conf.DNS.Timeout, t)
+}
+
+func TestBittorrentLeakV2(t *testing.T) {
+	conf.BitTorrent.Timeout = timeout
+	conf.Host = "test"
+	bittorrentTrackerPort = 1337
+	bittorrentHTTPTrackerPort = 6969
+	bittorrentDHTPort = 6881
+	bittorrentPeerPort = 6882
+	conf.IPv4Host = "ipv4.test"
+	conf.IPv6Host = "ipv6.test"
+	conf.BitTorrent.WebTorrentURL = "wss://test/webtorrent"
+	defer func() {
+		conf.IPv4Host = ""
+		conf.IPv6Host = ""
+		conf.BitTorrent.WebTorrentURL = ""
+		bittorrentHTTPTrackerPort = 0
+		bittorrentDHTPort = 0
+		bittorrentPeerPort = 0
+	}()
+	tracker := newMockTracker()
+	bittorrentTracker = tracker
+	ws := wsConnectVersion(PROTOCOL_V2, "bittorrent", t)
+	params := struct {
+		paramsMessage
+		Params bittorrentTestParams `json:"params"`
+	}{}
+	ws.readJson(&params, t)
+	if params.Type != MESSAGE_PARAMS || params.Test != TEST_BITTORRENT {
+		utils.TErrorf(t, "Invalid params message: %s/%s", params.Type, params.Test)
+	}
+	re := regexp.MustCompile(`^magnet:\?xt=urn:btih:` + params.Params.InfoHash + `&tr=udp://test:1337(/[a-z2-7]{26,})&tr=udp://ipv4\.test:1337(/[a-z2-7]{26,})&tr=udp://ipv6\.test:1337(/[a-z2-7]{26,})&tr=http://test:6969/announce&tr=wss://test/webtorrent&x\.pe=test:6882&dht=test:6881$`)
+	matches := re.FindStringSubmatch(params.Params.Magnet)
+	if matches == nil || matches[2] != matches[1] || matches[3] != matches[1] {
+		utils.TFatalf(t, "Invalid magnet link received: %s", params.Params.Magnet)
+	}
+	trackerPath := matches[1]
+	infoHash, err := hex.DecodeString(params.Params.InfoHash)
+	if err != nil {
+		utils.TFatalf(t, "Failed to decode info hash %s: %s", params.Params.InfoHash, err)
+	}
+	f, ok := tracker.callback(bittorrent.InfoHash(infoHash))
+	if !ok {
+		utils.TFatalf(t, "Info hash %s not registered", params.Params.InfoHash)
+	}
+	ip := utils.RandomIPv4()
+	go func() {
+		f(bittorrent.Peer{
+			IP:         ip,
+			Port:       6881,
+			Protocol:   bittorrent.PROTOCOL_UDP,
+			Request:    bittorrent.REQUEST_ANNOUNCE,
+			PeerID:     "-qB4620-abcdefghijkl",
+			ListenPort: 51413,
+			Key:        "0badcafe",
+			Event:      "started",
+			URLData:    trackerPath,
+		})
+		f(bittorrent.Peer{IP: ip, Port: 6881, Protocol: bittorrent.PROTOCOL_UDP, Request: bittorrent.REQUEST_SCRAPE})
+		f(bittorrent.Peer{IP: ip, Port: 40000, Protocol: bittorrent.PROTOCOL_HTTP, Request: bittorrent.REQUEST_SCRAPE})
+		f(bittorrent.Peer{IP: net.IPv4(192, 168, 1, 10), Port: 50000, Protocol: bittorrent.PROTOCOL_WEBRTC, Request: bittorrent.REQUEST_OFFER, Candidate: "host"})
+		f(bittorrent.Peer{
+			IP:         ip,
+			Port:       40001,
+			Protocol:   bittorrent.PROTOCOL_PEER_WIRE,
+			Request:    bittorrent.REQUEST_HANDSHAKE,
+			PeerID:     "-qB4650-abcdefghijkl",
+			Client:     "qBittorrent/4.6.5",
+			YourIP:     net.IPv4(192, 0, 2, 1),
+			ListenPort: 51413,
+		})
+	}()
+	event := ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_BITTORRENT, IP: ip.String(), Port: 6881, Protocol: bittorrent.PROTOCOL_UDP, InfoHash: params.Params.InfoHash}, t)
+	if event.Metadata["request"] != bittorrent.REQUEST_ANNOUNCE {
+		utils.TErrorf(t, "Invalid tracker request in metadata: %v", event.Metadata)
+	}
+	if event.Metadata["client"] != "qBittorrent 4.6.2" || event.Metadata["listen_port"] != float64(51413) || event.Metadata["key"] != "0badcafe" || event.Metadata["event"] != "started" || event.Metadata["url_data"] != trackerPath {
+		utils.TErrorf(t, "Invalid announce metadata: %v", event.Metadata)
+	}
+	event = ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_BITTORRENT, IP: ip.String(), Port: 40000, Protocol: bittorrent.PROTOCOL_HTTP, InfoHash: params.Params.InfoHash}, t)
+	if event.Metadata["request"] != bittorrent.REQUEST_SCRAPE {
+		utils.TErrorf(t, "Invalid tracker request in metadata: %v", event.Metadata)
+	}
+	event = ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_BITTORRENT, IP: "192.168.1.10", Port: 50000, Protocol: bittorrent.PROTOCOL_WEBRTC, InfoHash: params.Params.InfoHash}, t)
+	if event.Metadata["request"] != bittorrent.REQUEST_OFFER || event.Metadata["candidate"] != "host" {
+		utils.TErrorf(t, "Invalid WebRTC candidate metadata: %v", event.Metadata)
+	}
+	event = ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_BITTORRENT, IP: ip.String(), Port: 40001, Protocol: bittorrent.PROTOCOL_PEER_WIRE, InfoHash: params.Params.InfoHash}, t)
+	if event.Metadata["peer_id"] != hex.EncodeToString([]byte("-qB4650-abcdefghijkl")) || event.Metadata["client"] != "qBittorrent/4.6.5" || event.Metadata["yourip"] != "192.0.2.1" || event.Metadata["listen_port"] != float64(51413) {
+		utils.TErrorf(t, "Invalid peer-wire metadata: %v", event.Metadata)
+	}
+	done := new(doneMessage)
+	ws.readJson(done, t)
+	if done.Type != MESSAGE_DONE || done.Leaks != 4 || len(done.IPs) != 2 {
+		utils.TErrorf(t, "Invalid done message: %+v", done)
+	}
+	if verdict := ws.readVerdict(t); !verdict.Leaked || len(verdict.Addresses) != 2 || verdict.Addresses[1].IP != "192.168.1.10" || verdict.Addresses[1].Classes[0] != CLASS_BOGON {
+		utils.TErrorf(t, "Invalid verdict addresses: %+v", verdict.Addresses)
+	}
+	ws.assertEnd(conf.BitTorrent.Timeout, t)
+}
+
+func TestErrorV2(t *testing.T) {
+	ws := wsConnectVersion(PROTOCOL_V2, "dnssec", t)
+	msg := new(errorMessage)
+	ws.readJson(msg, t)
+	if msg.Type != MESSAGE_ERROR || msg.Code != ERROR_DNSSEC_DISABLED {
+		utils.TErrorf(t, "Invalid error message: %+v", msg)
+	}
+	if _, _, err := ws.ws.Read(ws.ctx); websocket.CloseStatus(err) != websocket.StatusInternalError {
+		utils.TErrorf(t, "Invalid close status: %s", err)
+	}
+}
+
+func TestWebrtcLeakV2(t *testing.T) {
+	conf.STUN.Timeout = timeout
+	conf.Host = "test"
+	conf.IPv6Host = "ipv6.test"
+	stunPort = 3478
+	turnPort = 3479
+	turnTLSPort = 5349
+	helperAddresses = []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")}
+	defer func() {
+		conf.IPv6Host = ""
+		stunPort = 0
+		turnPort = 0
+		turnTLSPort = 0
+		helperAddresses = nil
+	}()
+	logger := newMockSTUNLogger()
+	stunServer = logger
+	turnLogger := newMockTURNLogger()
+	turnServer = turnLogger
+	ws := wsConnectVersion(PROTOCOL_V2, "webrtc", t)
+	params := struct {
+		paramsMessage
+		Params webrtcTestParams `json:"params"`
+	}{}
+	ws.readJson(&params, t)
+	if params.Type != MESSAGE_PARAMS || params.Test != TEST_WEBRTC || params.Params.Password != "password of "+params.Params.Username {
+		utils.TFatalf(t, "Invalid params message: %+v", params)
+	}
+	if strings.Join(params.Params.URLs, " ") != "stun:test:3478 stun:ipv6.test:3478" {
+		utils.TErrorf(t, "Invalid STUN URLs: %v", params.Params.URLs)
+	}
+	if strings.Join(params.Params.Candidates, " ") != "192.0.2.1:3478 [2001:db8::1]:3478" {
+		utils.TErrorf(t, "Invalid candidates: %v", params.Params.Candidates)
+	}
+	turnParams := params.Params.TURN
+	if turnParams == nil || turnParams.Username != "1700000000:"+params.Params.Username || turnParams.Credential != "credential of "+params.Params.Username {
+		utils.TFatalf(t, "Invalid TURN params: %+v", turnParams)
+	}
+	if strings.Join(turnParams.URLs, " ") != "turn:test:3479?transport=udp turn:test:3479?transport=tcp turns:test:5349?transport=tcp" {
+		utils.TErrorf(t, "Invalid TURN URLs: %v", turnParams.URLs)
+	}
+	relay, ok := turnLogger.callback(params.Params.Username)
+	if !ok {
+		utils.TFatalf(t, "Username %s not registered in the TURN server", params.Params.Username)
+	}
+	f, ok := logger.callback(params.Params.Username)
+	if !ok {
+		utils.TFatalf(t, "Username %s not registered", params.Params.Username)
+	}
+	ip := utils.RandomIPv4()
+	go func() {
+		f(stun.Binding{IP: ip, Port: 50000, Transport: stun.TRANSPORT_UDP, Username: params.Params.Username + ":h6vY", Software: "libwebrtc"})
+		f(stun.Binding{IP: ip, Port: 50001, Transport: stun.TRANSPORT_UDP, Username: params.Params.Username + ":h6vY"})
+		relay(stun.Binding{IP: ip, Port: 50002, Transport: turn.TRANSPORT_TLS, Relay: true})
+	}()
+	event := ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_WEBRTC, IP: ip.String(), Port: 50000, Protocol: stun.TRANSPORT_UDP}, t)
+	if event.Metadata["software"] != "libwebrtc" {
+		utils.TErrorf(t, "Invalid binding metadata: %v", event.Metadata)
+	}
+	event = ws.readAssertEqualsLeakEvent(leakEvent{Test: TEST_WEBRTC, IP: ip.String(), Port: 50002, Protocol: turn.TRANSPORT_TLS}, t)
+	if event.Metadata["relay"] != true {
+		utils.TErrorf(t, "Invalid TURN metadata: %v", event.Metadata)
+	}
+	done := new(doneMessage)
+	ws.readJson(done, t)
+	if done.Type != MESSAGE_DONE || done.Leaks != 2 || len(done.IPs) != 1 {
+		utils.TErrorf(t, "Invalid done message: %+v", done)
+	}
+	ws.assertEnd(conf.STUN.Timeout, t)
+	if logger.len() != 0 || turnLogger.len() != 0 {
+		utils.TErrorf(t, "Username not unregistered")
+	}
+}